@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"text/template"
+)
+
+// Message used to render sample group and stream names.
+var sampleMessage = syslogMessage{
+	Facility:  logUser,
+	Severity:  logInfo,
+	Message:   "sample message",
+	Syslogtag: "app[123]:",
+	Hostname:  "host",
+	Format:    formatRFC3164,
+	Program:   "app",
+	PID:       "123",
+	AppName:   "app",
+}
+
+/*
+Validate config file without opening sockets or calling AWS. All errors are
+written to out, followed by group and stream names rendered for a sample
+message when config is valid. Returns process exit code.
+*/
+func checkConfig(file string, out io.Writer) int {
+	config, err := LoadConfig(file)
+	if err != nil {
+		fmt.Fprintf(out, "could not read config file %s\n", err)
+		return 1
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	agent := sampleStreamVars()
+	for _, flow := range config.GetFlows() {
+		for _, dst := range flow.destinations() {
+			for _, warning := range hostnameWarnings(dst) {
+				fmt.Fprintf(out, "[%s] warning: %s\n", dst.Name, warning)
+			}
+			group, stream := sampleNames(dst, agent)
+			fmt.Fprintf(out, "[%s] group %s stream %s\n", dst.Name, group, stream)
+		}
+	}
+	fmt.Fprintf(out, "%s is valid\n", file)
+	return 0
+}
+
+// Agent variables without querying EC2 metadata.
+func sampleStreamVars() streamVars {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "UNKNOWN"
+	}
+	return streamVars{InstanceID: "i-0123456789abcdef0", Hostname: hostname}
+}
+
+// Templates are expected to be validated.
+func sampleNames(cfg *FlowCfg, agent streamVars) (group, stream string) {
+	cache := &destinationCache{
+		group:  template.Must(template.New("").Parse(cfg.Group)),
+		stream: template.Must(template.New("").Parse(cfg.Stream)),
+		agent:  agent,
+		buf:    bytes.NewBuffer([]byte{}),
+	}
+	return cache.resolve(sampleMessage)
+}
+
+/*
+Hostname in group and stream is hostname of message sender. It used to be
+agent hostname, which is now AgentHostname.
+*/
+func hostnameWarnings(cfg *FlowCfg) (warnings []string) {
+	names := []struct{ key, value string }{{groupKey, cfg.Group}, {streamKey, cfg.Stream}}
+	for _, name := range names {
+		tpl := template.Must(template.New("").Parse(name.value))
+		if usesField(tpl, func(field string) bool { return field == "Hostname" }) {
+			warnings = append(warnings, fmt.Sprintf("%s uses {{.Hostname}} of message sender, use {{.AgentHostname}} for agent hostname", name.key))
+		}
+	}
+	return
+}
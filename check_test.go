@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func checkFile(t *testing.T, content string) (int, string) {
+	file, remove := tempConfig(t, "config.ini", content)
+	defer remove()
+	out := bytes.NewBuffer([]byte{})
+	code := checkConfig(file, out)
+	return code, out.String()
+}
+
+// Assert that errors of all sections are reported with section and key.
+func Test_checkConfig_errors(t *testing.T) {
+	code, out := checkFile(t, `
+[main]
+log_level = loud
+[app]
+group = app:bad
+stream = app
+source = ftp://localhost
+cloudwatch_format = {{.Message}}
+syslog_format = RFC3164
+[route:app.errors]
+group = errors
+stream =
+`)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, `[main] log_level invalid value
+[app] group invalid value
+[app] source invalid network scheme
+[route:app.errors] stream empty value
+`, out)
+}
+
+func Test_checkConfig_valid(t *testing.T) {
+	code, out := checkFile(t, `
+[app]
+group = app
+stream = {{.Hostname}}/{{.Program}}
+source = udp://localhost:5514
+cloudwatch_format = {{.Message}}
+syslog_format = RFC3164
+[route:app.errors]
+group = errors
+stream = {{.InstanceID}}
+`)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "[route:app.errors] group errors stream i-0123456789abcdef0\n")
+	assert.Contains(t, out, "[app] group app stream host/app\n")
+	assert.Contains(t, out, "[app] warning: stream uses {{.Hostname}} of message sender, use {{.AgentHostname}} for agent hostname\n")
+	assert.NotContains(t, out, "[route:app.errors] warning")
+}
+
+func Test_checkConfig_missing_file(t *testing.T) {
+	out := bytes.NewBuffer([]byte{})
+	assert.Equal(t, 1, checkConfig("/nonexistent/config", out))
+}
@@ -31,10 +31,22 @@ const (
 	putLogEventsDelay = 200 * time.Millisecond
 )
 
+// How much of rejected message is logged.
+const rejectedSampleLen = 100
+
 type logEvent struct {
 	msg string
 	// Timestamp in milliseconds
 	timestamp int64
+	// Arrival order within flow, keeps order of events with equal timestamps
+	seq uint64
+	// Spool segment holding event, 0 when event is kept in memory only
+	segment int
+}
+
+// CloudWatch timestamps are milliseconds since epoch.
+func toMillis(ts time.Time) int64 {
+	return ts.UnixNano() / int64(time.Millisecond)
 }
 
 func (e *logEvent) size() int {
@@ -53,13 +65,42 @@ type destination struct {
 	group  string
 	token  *string
 	svc    *cloudwatchlogs.CloudWatchLogs
+	retry  backoff
+	// Put events rejected as too new back to queue.
+	requeueTooNew bool
+	// Events rejected as too new, held until they are within maxFuture.
+	tooNew    eventsList
+	maxFuture time.Duration
+	// Held events are limited like queued ones, 0 maxHeldBytes means no byte limit.
+	maxHeld      queue_size
+	maxHeldBytes int64
+	heldBytes    int64
+	rejected     rejectCounters
 }
 
-func newDestination(stream, group string) *destination {
+// Number of events rejected by CloudWatch per reason.
+type rejectCounters struct {
+	tooOld  uint64
+	tooNew  uint64
+	expired uint64
+	// Too new events dropped because held events reached queue limits
+	heldDropped uint64
+}
+
+func newDestination(stream, group string, cfg *FlowCfg) *destination {
 	dst := &destination{
-		svc:    cwlogs,
-		stream: stream,
-		group:  group,
+		svc:           cwlogs,
+		stream:        stream,
+		group:         group,
+		retry:         backoff{maxAge: cfg.MaxRetryAge},
+		requeueTooNew: cfg.RequeueTooNew,
+		maxFuture:     cfg.MaxEventFuture,
+		maxHeld:       cfg.QueueSize,
+	}
+	dst.maxHeldBytes, _ = parseByteSize(cfg.QueueMaxBytes)
+	// CloudWatch limit applies even when window is disabled.
+	if dst.maxFuture == 0 {
+		dst.maxFuture = defaultMaxEventFuture
 	}
 	log.Debugf("%s setting token", dst)
 	dst.setToken()
@@ -68,7 +109,7 @@ func newDestination(stream, group string) *destination {
 
 // Put log events and update sequence token.
 // Possible errors http://docs.aws.amazon.com/AmazonCloudWatchLogs/latest/APIReference/API_PutLogEvents.html
-func (dst *destination) upload(events eventsList) error {
+func (dst *destination) upload(events eventsList) (rejected rejectedEvents, err error) {
 	logevents := make([]*cloudwatchlogs.InputLogEvent, 0, len(events))
 	for _, elem := range events {
 		logevents = append(logevents, &cloudwatchlogs.InputLogEvent{
@@ -82,14 +123,118 @@ func (dst *destination) upload(events eventsList) error {
 		LogStreamName: aws.String(dst.stream),
 		SequenceToken: dst.token,
 	}
-	// When rejectedLogEventsInfo is not empty, app can not
-	// do anything reasonable with rejected logs. Ignore it.
-	// Meybe expose some statistics for rejected counters.
 	resp, err := dst.svc.PutLogEvents(params)
 	if err == nil {
 		dst.token = resp.NextSequenceToken
+		rejected = newRejectedEvents(resp.RejectedLogEventsInfo, len(events))
 	}
-	return err
+	return
+}
+
+/*
+Index ranges of events rejected within uploaded batch.
+Events in [0, expiredEnd) are expired, [expiredEnd, tooOldEnd) are too old
+and [tooNewStart, batch length) are too new.
+*/
+type rejectedEvents struct {
+	expiredEnd  int
+	tooOldEnd   int
+	tooNewStart int
+}
+
+func newRejectedEvents(info *cloudwatchlogs.RejectedLogEventsInfo, num int) rejectedEvents {
+	rejected := rejectedEvents{tooNewStart: num}
+	if info == nil {
+		return rejected
+	}
+	if info.ExpiredLogEventEndIndex != nil {
+		rejected.expiredEnd = clampIndex(*info.ExpiredLogEventEndIndex, num)
+	}
+	rejected.tooOldEnd = rejected.expiredEnd
+	if info.TooOldLogEventEndIndex != nil {
+		rejected.tooOldEnd = clampIndex(*info.TooOldLogEventEndIndex, num)
+		if rejected.tooOldEnd < rejected.expiredEnd {
+			rejected.tooOldEnd = rejected.expiredEnd
+		}
+	}
+	if info.TooNewLogEventStartIndex != nil {
+		rejected.tooNewStart = clampIndex(*info.TooNewLogEventStartIndex, num)
+		if rejected.tooNewStart < rejected.tooOldEnd {
+			rejected.tooNewStart = rejected.tooOldEnd
+		}
+	}
+	return rejected
+}
+
+func clampIndex(index int64, num int) int {
+	if index < 0 {
+		return 0
+	}
+	if index > int64(num) {
+		return num
+	}
+	return int(index)
+}
+
+// Count and log rejected events. Return events which should be uploaded again.
+func (dst *destination) countRejected(batch eventsList, rejected rejectedEvents) (retry eventsList) {
+	dst.logRejected("expired", &dst.rejected.expired, batch[:rejected.expiredEnd])
+	dst.logRejected("too old", &dst.rejected.tooOld, batch[rejected.expiredEnd:rejected.tooOldEnd])
+	tooNew := batch[rejected.tooNewStart:]
+	dst.logRejected("too new", &dst.rejected.tooNew, tooNew)
+	if dst.requeueTooNew {
+		return tooNew
+	}
+	return nil
+}
+
+/*
+Keep events rejected as too new until they can be accepted. Events over
+queue_size or queue_max_bytes are not held, they are returned as dropped.
+*/
+func (dst *destination) hold(events eventsList) (dropped eventsList) {
+	for i, event := range events {
+		size := int64(event.size())
+		if len(dst.tooNew) >= int(dst.maxHeld) || (dst.maxHeldBytes > 0 && dst.heldBytes+size > dst.maxHeldBytes) {
+			dropped = events[i:]
+			break
+		}
+		dst.tooNew = append(dst.tooNew, event)
+		dst.heldBytes += size
+	}
+	if len(dropped) > 0 {
+		dst.rejected.heldDropped += uint64(len(dropped))
+		log.Warnf("%s too many held events, dropped %d too new events (%d in total)", dst, len(dropped), dst.rejected.heldDropped)
+	}
+	return
+}
+
+// Return held events which are now within window accepted by CloudWatch.
+func (dst *destination) release(now time.Time) (ready eventsList) {
+	newest := toMillis(now.Add(dst.maxFuture - windowMargin))
+	held := dst.tooNew[:0]
+	for _, event := range dst.tooNew {
+		if event.timestamp <= newest {
+			ready = append(ready, event)
+			dst.heldBytes -= int64(event.size())
+		} else {
+			held = append(held, event)
+		}
+	}
+	dst.tooNew = held
+	return
+}
+
+func (dst *destination) logRejected(reason string, counter *uint64, events eventsList) {
+	if len(events) == 0 {
+		return
+	}
+	*counter += uint64(len(events))
+	sample := events[0].msg
+	if len(sample) > rejectedSampleLen {
+		sample = sample[:rejectedSampleLen]
+	}
+	log.Warnf("%s rejected %d %s events (%d in total), sample: %q", dst, len(events), reason, *counter, sample)
 }
 
 // For newly created log streams, token is an empty string.
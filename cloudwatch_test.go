@@ -2,7 +2,10 @@ package main
 
 import (
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,3 +24,70 @@ func Test_destination_string(t *testing.T) {
 	dst := destination{group: "group", stream: "stream"}
 	assert.Equal(t, "group: group stream: stream", dst.String())
 }
+
+func Test_toMillis(t *testing.T) {
+	ts := time.Date(2017, 7, 23, 14, 48, 16, 123456789, time.UTC)
+	assert.Equal(t, int64(1500821296123), toMillis(ts))
+}
+
+func Test_newRejectedEvents_none(t *testing.T) {
+	assert.Equal(t, rejectedEvents{tooNewStart: 3}, newRejectedEvents(nil, 3))
+}
+
+func Test_newRejectedEvents(t *testing.T) {
+	info := &cloudwatchlogs.RejectedLogEventsInfo{
+		ExpiredLogEventEndIndex:  aws.Int64(1),
+		TooOldLogEventEndIndex:   aws.Int64(2),
+		TooNewLogEventStartIndex: aws.Int64(4),
+	}
+	assert.Equal(t, rejectedEvents{expiredEnd: 1, tooOldEnd: 2, tooNewStart: 4}, newRejectedEvents(info, 5))
+}
+
+// Assert that indexes outside of batch do not cause out of range slicing.
+func Test_newRejectedEvents_out_of_range(t *testing.T) {
+	info := &cloudwatchlogs.RejectedLogEventsInfo{
+		TooOldLogEventEndIndex:   aws.Int64(10),
+		TooNewLogEventStartIndex: aws.Int64(-1),
+	}
+	assert.Equal(t, rejectedEvents{tooOldEnd: 2, tooNewStart: 2}, newRejectedEvents(info, 2))
+}
+
+func Test_countRejected(t *testing.T) {
+	batch := eventsList{{msg: "expired"}, {msg: "old"}, {msg: "ok"}, {msg: "new"}}
+	rejected := rejectedEvents{expiredEnd: 1, tooOldEnd: 2, tooNewStart: 3}
+	dst := &destination{}
+	assert.Nil(t, dst.countRejected(batch, rejected))
+	assert.Equal(t, rejectCounters{expired: 1, tooOld: 1, tooNew: 1}, dst.rejected)
+}
+
+// Assert that too new events are held back until they are within accepted window.
+func Test_handleRejected_requeue(t *testing.T) {
+	now := time.Now()
+	future := toMillis(now.Add(3 * time.Hour))
+	batch := eventsList{{seq: 1}, {seq: 2}, {seq: 3, timestamp: future}}
+	queue := &eventQueue{max_size: 10}
+	dst := &destination{requeueTooNew: true, maxFuture: 2 * time.Hour, maxHeld: 10}
+	handleRejected(dst, rejectedEvents{expiredEnd: 1, tooOldEnd: 1, tooNewStart: 2})(batch, queue)
+	assert.Empty(t, queue.events)
+	assert.Empty(t, dst.release(now))
+	assert.Equal(t, eventsList{{seq: 3, timestamp: future}}, dst.release(now.Add(time.Hour+2*windowMargin)))
+	assert.Empty(t, dst.tooNew)
+}
+
+// Assert that held events are limited by queue size and bytes.
+func Test_destination_hold_limits(t *testing.T) {
+	now := time.Now()
+	future := toMillis(now.Add(3 * time.Hour))
+	dst := &destination{maxFuture: 2 * time.Hour, maxHeld: 2}
+	events := eventsList{{seq: 1, timestamp: future}, {seq: 2, timestamp: future}, {seq: 3, timestamp: future}}
+	assert.Equal(t, events[2:], dst.hold(events))
+	assert.Equal(t, events[:2], dst.tooNew)
+	assert.Equal(t, uint64(1), dst.rejected.heldDropped)
+
+	event := logEvent{msg: "message", timestamp: future}
+	dst = &destination{maxFuture: 2 * time.Hour, maxHeld: 10, maxHeldBytes: int64(event.size())}
+	assert.Empty(t, dst.hold(eventsList{event}))
+	assert.Equal(t, eventsList{event}, dst.hold(eventsList{event}))
+	assert.Equal(t, eventsList{event}, dst.release(now.Add(time.Hour+2*windowMargin)))
+	assert.Empty(t, dst.hold(eventsList{event}))
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/go-ini/ini"
@@ -12,19 +20,64 @@ import (
 
 const (
 	minUploadDelay = 200
+	// Timeouts are checked by tickers running at half the timeout.
+	minTimeout = 2 * time.Millisecond
 
-	mainSectionName = "main"
+	defaultSpoolSegmentSize = 16 * 1024 * 1024
+	defaultMaxRetryAge      = time.Hour
+	// CloudWatch rejects events older than 14 days or more than 2 hours in the future.
+	defaultMaxEventAge    = 14 * 24 * time.Hour
+	defaultMaxEventFuture = 2 * time.Hour
+
+	mainSectionName    = "main"
+	routeSectionPrefix = "route:"
 
 	logOutputKey = "log_output"
 	logLevelKey  = "log_level"
-
-	sourceKey           = "source"
-	groupKey            = "group"
-	streamKey           = "stream"
-	cloudwatchFormatKey = "cloudwatch_format"
-	syslogFormatKey     = "syslog_format"
-	queueSizeKey        = "queue_size"
-	uploadDelayKey      = "upload_delay"
+	includeKey   = "include"
+
+	sourceKey            = "source"
+	groupKey             = "group"
+	streamKey            = "stream"
+	cloudwatchFormatKey  = "cloudwatch_format"
+	syslogFormatKey      = "syslog_format"
+	queueSizeKey         = "queue_size"
+	overflowPolicyKey    = "overflow_policy"
+	queueMaxBytesKey     = "queue_max_bytes"
+	uploadDelayKey       = "upload_delay"
+	maxRetryAgeKey       = "max_retry_age"
+	requeueTooNewKey     = "requeue_too_new"
+	maxEventAgeKey       = "max_event_age"
+	maxEventFutureKey    = "max_event_future"
+	outOfWindowKey       = "out_of_window"
+	oversizedMessageKey  = "oversized_message"
+	truncateMarkerKey    = "truncate_marker"
+	multilineStartKey    = "multiline_start"
+	multilineContKey     = "multiline_continue"
+	multilineTimeoutKey  = "multiline_timeout"
+	multilineMaxSizeKey  = "multiline_max_size"
+	idleTimeoutKey       = "idle_timeout"
+	minSeverityKey       = "min_severity"
+	includeFacilitiesKey = "include_facilities"
+	excludeFacilitiesKey = "exclude_facilities"
+	includeTagsKey       = "include_tags"
+	excludeTagsKey       = "exclude_tags"
+	includeMessagesKey   = "include_messages"
+	excludeMessagesKey   = "exclude_messages"
+	socketModeKey        = "socket_mode"
+	socketOwnerKey       = "socket_owner"
+	tlsCertFileKey       = "tls_cert_file"
+	tlsKeyFileKey        = "tls_key_file"
+	tlsCAFileKey         = "tls_ca_file"
+	tlsClientAuthKey     = "tls_client_auth"
+	jsonMessageKey       = "json_message"
+	jsonTimeKeyKey       = "json_time_key"
+	jsonTimeLayoutKey    = "json_time_layout"
+	timezoneKey          = "timezone"
+	maxClockSkewKey      = "max_clock_skew"
+	spoolDirKey          = "spool_dir"
+	spoolSegmentSizeKey  = "spool_segment_size"
+	spoolFsyncKey        = "spool_fsync"
 
 	debugLevelOption = "debug"
 	infoLevelOption  = "info"
@@ -39,7 +92,7 @@ const (
 type (
 	logoutput    uint8
 	upload_delay uint16
-	queue_size   uint16
+	queue_size   uint32
 )
 
 type Configuration interface {
@@ -54,13 +107,68 @@ type MainCfg struct {
 }
 
 type FlowCfg struct {
-	Group            string       `ini:"group"`
-	Stream           string       `ini:"stream"`
-	SyslogFormat     string       `ini:"syslog_format"`
-	CloudwatchFormat string       `ini:"cloudwatch_format"`
-	Source           string       `ini:"source"`
-	UploadDelay      upload_delay `ini:"upload_delay"`
-	QueueSize        queue_size   `ini:"queue_size"`
+	Group             string        `ini:"group"`
+	Stream            string        `ini:"stream"`
+	SyslogFormat      string        `ini:"syslog_format"`
+	CloudwatchFormat  string        `ini:"cloudwatch_format"`
+	Source            string        `ini:"source"`
+	UploadDelay       upload_delay  `ini:"upload_delay"`
+	MaxRetryAge       time.Duration `ini:"max_retry_age"`
+	RequeueTooNew     bool          `ini:"requeue_too_new"`
+	MaxEventAge       time.Duration `ini:"max_event_age"`
+	MaxEventFuture    time.Duration `ini:"max_event_future"`
+	OutOfWindow       string        `ini:"out_of_window"`
+	OversizedMessage  string        `ini:"oversized_message"`
+	TruncateMarker    string        `ini:"truncate_marker"`
+	MultilineStart    string        `ini:"multiline_start"`
+	MultilineContinue string        `ini:"multiline_continue"`
+	MultilineTimeout  time.Duration `ini:"multiline_timeout"`
+	MultilineMaxSize  string        `ini:"multiline_max_size"`
+	QueueSize         queue_size    `ini:"queue_size"`
+	OverflowPolicy    string        `ini:"overflow_policy"`
+	QueueMaxBytes     string        `ini:"queue_max_bytes"`
+	SocketMode        string        `ini:"socket_mode"`
+	SocketOwner       string        `ini:"socket_owner"`
+	TLSCertFile       string        `ini:"tls_cert_file"`
+	TLSKeyFile        string        `ini:"tls_key_file"`
+	TLSCAFile         string        `ini:"tls_ca_file"`
+	TLSClientAuth     bool          `ini:"tls_client_auth"`
+	JSONMessage       bool          `ini:"json_message"`
+	JSONTimeKey       string        `ini:"json_time_key"`
+	JSONTimeLayout    string        `ini:"json_time_layout"`
+	Timezone          string        `ini:"timezone"`
+	MaxClockSkew      time.Duration `ini:"max_clock_skew"`
+	SpoolDir          string        `ini:"spool_dir"`
+	SpoolSegmentSize  int64         `ini:"spool_segment_size"`
+	SpoolFsync        string        `ini:"spool_fsync"`
+	IdleTimeout       time.Duration `ini:"idle_timeout"`
+	// Section name
+	Name   string      `ini:"-"`
+	Filter FilterCfg   `ini:"-"`
+	Routes []*RouteCfg `ini:"-"`
+}
+
+// Message filter options, mapped from flow and route sections.
+type FilterCfg struct {
+	MinSeverity       string   `ini:"min_severity"`
+	IncludeFacilities []string `ini:"include_facilities" delim:","`
+	ExcludeFacilities []string `ini:"exclude_facilities" delim:","`
+	IncludeTags       []string `ini:"include_tags" delim:","`
+	ExcludeTags       []string `ini:"exclude_tags" delim:","`
+	IncludeMessages   string   `ini:"include_messages"`
+	ExcludeMessages   string   `ini:"exclude_messages"`
+}
+
+/*
+Route section is named after its flow and route name separated by a dot
+and prefixed with route: e.g. [route:app-logs.errors]. Messages passing route
+filter are sent to route group and stream instead of flow ones.
+*/
+type RouteCfg struct {
+	Name   string    `ini:"-"`
+	Group  string    `ini:"group"`
+	Stream string    `ini:"stream"`
+	Filter FilterCfg `ini:"-"`
 }
 
 const (
@@ -100,93 +208,396 @@ type IniConfig struct {
 	config *ini.File
 }
 
-func NewIniConfig(file string) Configuration {
-	config, err := ini.Load(file)
+// Load INI or YAML config depending on file extension, exit on error.
+func NewConfig(file string) Configuration {
+	config, err := LoadConfig(file)
 	if err != nil {
 		log.Fatalf("could not read config file %s", err)
 	}
+	return config
+}
+
+// Same as NewConfig but returns error instead of exiting.
+func LoadConfig(file string) (Configuration, error) {
+	config, err := loadConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := includeConfigFiles(config, file); err != nil {
+		return nil, err
+	}
+	if isYamlFile(file) {
+		return &YamlConfig{IniConfig{config: config}}, nil
+	}
+	return &IniConfig{config: config}, nil
+}
+
+// Load single file and expand environment variables in its values.
+func loadConfigFile(file string) (config *ini.File, err error) {
+	if isYamlFile(file) {
+		config, err = loadYamlFile(file)
+	} else {
+		config, err = ini.Load(file)
+	}
+	if err != nil {
+		return nil, err
+	}
 	// Remove unused default section
 	config.DeleteSection(ini.DEFAULT_SECTION)
-	return &IniConfig{config: config}
+	var errs configErrors
+	for _, section := range config.Sections() {
+		for _, key := range section.Keys() {
+			value, err := expandEnv(key.Value())
+			if err != nil {
+				errs.add(section.Name(), keyError(key.Name(), err))
+				continue
+			}
+			key.SetValue(value)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return config, nil
+}
+
+/*
+Merge sections of files matching include patterns of main section. Relative
+patterns are resolved against directory of file. Included files can not
+include other files nor redefine existing sections.
+*/
+func includeConfigFiles(config *ini.File, file string) error {
+	main, err := config.GetSection(mainSectionName)
+	if err != nil || !main.HasKey(includeKey) {
+		return nil
+	}
+	var errs configErrors
+	for _, pattern := range main.Key(includeKey).Strings(",") {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(file), pattern)
+		}
+		names, err := filepath.Glob(pattern)
+		if err != nil {
+			errs.add(mainSectionName, keyError(includeKey, err))
+			continue
+		}
+		for _, name := range names {
+			included, err := loadConfigFile(name)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			for _, section := range included.Sections() {
+				if _, err := config.GetSection(section.Name()); err == nil {
+					errs.add(section.Name(), fmt.Errorf("%s in %s", errDuplicateSection, name))
+					continue
+				}
+				copied, _ := config.NewSection(section.Name())
+				for _, key := range section.Keys() {
+					copied.NewKey(key.Name(), key.Value())
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Replace ${VAR} and ${VAR:-default} with environment variables. Default is used when variable is unset or empty.
+func expandEnv(value string) (string, error) {
+	var err error
+	expanded := envPattern.ReplaceAllStringFunc(value, func(match string) string {
+		groups := envPattern.FindStringSubmatch(match)
+		if env := os.Getenv(groups[1]); env != "" {
+			return env
+		}
+		if groups[2] != "" {
+			return groups[3]
+		}
+		if _, ok := os.LookupEnv(groups[1]); !ok && err == nil {
+			err = fmt.Errorf("%s: %s", errUnsetVariable, groups[1])
+		}
+		return ""
+	})
+	return expanded, err
 }
 
 func (cfg IniConfig) GetMain() *MainCfg {
+	main, err := cfg.mapMain()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return main
+}
+
+func (cfg IniConfig) mapMain() (*MainCfg, error) {
 	main := new(MainCfg)
 	// Set default values
 	main.LogLevel = "error"
 	main.LogOutput = "syslog"
-	err := cfg.config.Section(mainSectionName).MapTo(main)
-	if err != nil {
-		log.Fatalf("could not map section %s: %s", mainSectionName, err)
+	if err := cfg.config.Section(mainSectionName).MapTo(main); err != nil {
+		return nil, fmt.Errorf("could not map section %s: %s", mainSectionName, err)
 	}
-	return main
+	return main, nil
 }
 
 // Return all flow configurations
-func (cfg IniConfig) GetFlows() (flows []*FlowCfg) {
+func (cfg IniConfig) GetFlows() []*FlowCfg {
+	flows, errs := cfg.mapFlows()
+	if len(errs) > 0 {
+		log.Fatal(errs)
+	}
+	return flows
+}
+
+// Return flows which could be mapped and errors of sections which could not.
+func (cfg IniConfig) mapFlows() (flows []*FlowCfg, errs configErrors) {
+	byName := make(map[string]*FlowCfg)
+	var routes []*ini.Section
 	for _, section := range cfg.config.Sections() {
-		if section.Name() != mainSectionName {
-			flow := new(FlowCfg)
-			// Set default values
-			flow.UploadDelay = minUploadDelay
-			flow.QueueSize = 50000
-			err := section.MapTo(flow)
-			if err != nil {
-				log.Fatalf("could not map section %s: %s", mainSectionName, err)
-			}
-			flows = append(flows, flow)
+		if section.Name() == mainSectionName {
+			continue
+		}
+		if strings.HasPrefix(section.Name(), routeSectionPrefix) {
+			routes = append(routes, section)
+			continue
+		}
+		flow := new(FlowCfg)
+		// Set default values
+		flow.UploadDelay = minUploadDelay
+		flow.MaxRetryAge = defaultMaxRetryAge
+		flow.MaxEventAge = defaultMaxEventAge
+		flow.MaxEventFuture = defaultMaxEventFuture
+		flow.OutOfWindow = windowDropOption
+		flow.OversizedMessage = oversizeTruncateOption
+		flow.TruncateMarker = defaultTruncateMarker
+		flow.MultilineTimeout = defaultMultilineTimeout
+		flow.IdleTimeout = defaultIdleTimeout
+		flow.QueueSize = 50000
+		flow.OverflowPolicy = overflowDropNewest
+		flow.JSONTimeLayout = time.RFC3339Nano
+		flow.SpoolSegmentSize = defaultSpoolSegmentSize
+		flow.SpoolFsync = fsyncPeriodicOption
+		flow.Name = section.Name()
+		err := section.MapTo(flow)
+		if err == nil {
+			err = section.MapTo(&flow.Filter)
 		}
+		if err != nil {
+			errs.add(section.Name(), fmt.Errorf("could not map section: %s", err))
+			continue
+		}
+		flows = append(flows, flow)
+		byName[flow.Name] = flow
+	}
+	for _, section := range routes {
+		flowName, name, ok := routeName(section.Name())
+		if !ok {
+			errs.add(section.Name(), errInvalidRouteSection)
+			continue
+		}
+		if _, err := cfg.config.GetSection(flowName); err != nil || flowName == mainSectionName {
+			errs.add(section.Name(), fmt.Errorf("%s %s", errUnknownFlow, flowName))
+			continue
+		}
+		if err := checkRouteKeys(section); err != nil {
+			errs.add(section.Name(), err)
+			continue
+		}
+		route := &RouteCfg{Name: name}
+		err := section.MapTo(route)
+		if err == nil {
+			err = section.MapTo(&route.Filter)
+		}
+		if err != nil {
+			errs.add(section.Name(), fmt.Errorf("could not map section: %s", err))
+			continue
+		}
+		// Flow section could not be mapped
+		flow, ok := byName[flowName]
+		if !ok {
+			continue
+		}
+		flow.Routes = append(flow.Routes, route)
 	}
 	return
 }
 
-func (cfg IniConfig) Validate() error {
-	if err := validateMainCfg(cfg.GetMain()); err != nil {
-		return fmt.Errorf("error while validating main section: %s", err)
-	}
-	for _, flow := range cfg.GetFlows() {
-		if err := validateFlowCfg(flow); err != nil {
-			return fmt.Errorf("error while validating flow section: %s", err)
+// Options which may be set in route section.
+var routeKeys = []string{
+	groupKey, streamKey, minSeverityKey, includeFacilitiesKey, excludeFacilitiesKey,
+	includeTagsKey, excludeTagsKey, includeMessagesKey, excludeMessagesKey,
+}
+
+// Reject flow options set in route section, routes share them with their flow.
+func checkRouteKeys(section *ini.Section) error {
+	for _, key := range section.KeyStrings() {
+		if !strIn(routeKeys, key) {
+			return keyError(key, errNotRouteOption)
 		}
 	}
 	return nil
 }
 
-func validateMainCfg(cfg *MainCfg) error {
-	if err := validateLogLevel(cfg.LogLevel); err != nil {
-		return fmt.Errorf("log_level %s", err)
+// Split route section name e.g. route:app-logs.errors into flow and route name.
+func routeName(section string) (flow, route string, ok bool) {
+	if !strings.HasPrefix(section, routeSectionPrefix) {
+		return
 	}
-	if err := validateLogOutput(cfg.LogOutput); err != nil {
-		return fmt.Errorf("log_output %s", err)
+	name := strings.TrimPrefix(section, routeSectionPrefix)
+	i := strings.LastIndex(name, ".")
+	if i < 1 || i == len(name)-1 {
+		return
 	}
-	return nil
+	return name[:i], name[i+1:], true
 }
 
-func validateFlowCfg(cfg *FlowCfg) error {
-	if err := validateQueueSize(cfg.QueueSize); err != nil {
-		return err
-	}
-	if err := validateGroup(cfg.Group); err != nil {
-		return err
+// Name of route section.
+func routeSection(flow, route string) string {
+	return routeSectionPrefix + flow + "." + route
+}
+
+/*
+Configuration of each destination of flow, routes first and flow group and
+stream last. Filter of each destination selects messages sent to it. Route
+spool directory is a subdirectory of flow one.
+*/
+func (flow *FlowCfg) destinations() (dsts []*FlowCfg) {
+	for _, route := range flow.Routes {
+		dst := *flow
+		dst.Name = routeSection(flow.Name, route.Name)
+		dst.Group, dst.Stream, dst.Filter = route.Group, route.Stream, route.Filter
+		if flow.SpoolDir != "" {
+			dst.SpoolDir = filepath.Join(flow.SpoolDir, route.Name)
+		}
+		dsts = append(dsts, &dst)
 	}
-	if err := validateStrean(cfg.Stream); err != nil {
-		return err
+	dst := *flow
+	dst.Filter = FilterCfg{}
+	return append(dsts, &dst)
+}
+
+// Errors found in configuration, each prefixed with its section name.
+type configErrors []error
+
+func (errs *configErrors) add(section string, err error) {
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("[%s] %s", section, err))
 	}
-	if err := validateUploadDelay(cfg.UploadDelay); err != nil {
-		return err
+}
+
+func (errs configErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
 	}
-	if err := validateSource(cfg.Source); err != nil {
-		return err
+	return strings.Join(msgs, "\n")
+}
+
+// Prefix error with option name.
+func keyError(key string, err error) error {
+	if err == nil {
+		return nil
 	}
-	if err := validateCloudwatchFormat(cfg.CloudwatchFormat); err != nil {
-		return err
+	return fmt.Errorf("%s %s", key, err)
+}
+
+// Report errors of all sections, not only the first one.
+func (cfg IniConfig) Validate() error {
+	var errs configErrors
+	main, err := cfg.mapMain()
+	errs.add(mainSectionName, err)
+	if err == nil {
+		for _, err := range validateMainCfg(main) {
+			errs.add(mainSectionName, err)
+		}
 	}
-	if err := validateSyslogFormat(cfg.SyslogFormat); err != nil {
-		return err
+	flows, mapErrs := cfg.mapFlows()
+	errs = append(errs, mapErrs...)
+	errs = append(errs, validateFlows(flows)...)
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
 
+func validateFlows(flows []*FlowCfg) (errs configErrors) {
+	spoolDirs := make(map[string]bool)
+	for _, flow := range flows {
+		for _, err := range validateFlowCfg(flow) {
+			errs.add(flow.Name, err)
+		}
+		for _, route := range flow.Routes {
+			errs.add(routeSection(flow.Name, route.Name), validateRoute(route))
+		}
+		if flow.SpoolDir == "" {
+			continue
+		}
+		dir := filepath.Clean(flow.SpoolDir)
+		if spoolDirs[dir] {
+			errs.add(flow.Name, keyError(spoolDirKey, errDuplicateSpoolDir))
+		}
+		spoolDirs[dir] = true
+	}
+	return
+}
+
+func validateMainCfg(cfg *MainCfg) (errs []error) {
+	if err := validateLogLevel(cfg.LogLevel); err != nil {
+		errs = append(errs, keyError(logLevelKey, err))
+	}
+	if err := validateLogOutput(cfg.LogOutput); err != nil {
+		errs = append(errs, keyError(logOutputKey, err))
+	}
+	return
+}
+
+func validateFlowCfg(cfg *FlowCfg) (errs []error) {
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	add(keyError(queueSizeKey, validateQueueSize(cfg.QueueSize)))
+	_, err := parseByteSize(cfg.QueueMaxBytes)
+	add(keyError(queueMaxBytesKey, err))
+	add(keyError(overflowPolicyKey, validateOverflowPolicy(cfg)))
+	add(keyError(groupKey, validateNameTemplate(cfg.Group, validateGroup)))
+	add(keyError(streamKey, validateNameTemplate(cfg.Stream, validateStrean)))
+	add(keyError(idleTimeoutKey, validateIdleTimeout(cfg.IdleTimeout)))
+	add(keyError(uploadDelayKey, validateUploadDelay(cfg.UploadDelay)))
+	add(keyError(sourceKey, validateSource(cfg.Source)))
+	add(keyError(cloudwatchFormatKey, validateCloudwatchFormat(cfg.CloudwatchFormat)))
+	add(keyError(syslogFormatKey, validateSyslogFormat(cfg.SyslogFormat)))
+	add(keyError(socketModeKey, validateSocketMode(cfg.SocketMode)))
+	add(keyError(socketOwnerKey, validateSocketOwner(cfg.SocketOwner)))
+	add(validateSpool(cfg))
+	add(keyError(timezoneKey, validateTimezone(cfg.Timezone)))
+	if cfg.MaxRetryAge < 0 {
+		add(keyError(maxRetryAgeKey, errTooSmall))
+	}
+	add(validateMultiline(cfg))
+	add(validateFilter(&cfg.Filter))
+	if cfg.SpoolDir != "" && hasDynamicNames(cfg) {
+		add(keyError(spoolDirKey, errDynamicSpool))
+	}
+	add(validateOversize(cfg))
+	add(validateWindow(cfg))
+	if cfg.MaxClockSkew < 0 {
+		add(keyError(maxClockSkewKey, errTooSmall))
+	}
+	if cfg.JSONTimeKey != "" && cfg.JSONTimeLayout == "" {
+		add(keyError(jsonTimeLayoutKey, errEmptyValue))
+	}
+	if strings.HasPrefix(cfg.Source, "tls:") {
+		add(validateTLS(cfg))
+	}
+	return
+}
+
 // Validate source URL
 func validateSource(value string) error {
 	if value == "" {
@@ -198,15 +609,80 @@ func validateSource(value string) error {
 	}
 	// Valid schemes
 	var schemes = map[string]bool{
-		"udp": true,
+		"udp":      true,
+		"tcp":      true,
+		"tls":      true,
+		"unix":     true,
+		"unixgram": true,
 	}
 	// Check for valid scheme
 	if !schemes[uri.Scheme] {
 		return errInvalidScheme
 	}
+	if strings.HasPrefix(uri.Scheme, "unix") && socketPath(uri) == "" {
+		return errEmptySocketPath
+	}
 	return nil
 }
 
+// Certificate and key are mandatory. CA file is required only for client authentication.
+func validateTLS(cfg *FlowCfg) error {
+	if cfg.TLSCertFile == "" {
+		return fmt.Errorf("%s %s", tlsCertFileKey, errEmptyValue)
+	}
+	if cfg.TLSKeyFile == "" {
+		return fmt.Errorf("%s %s", tlsKeyFileKey, errEmptyValue)
+	}
+	if cfg.TLSClientAuth && cfg.TLSCAFile == "" {
+		return fmt.Errorf("%s %s", tlsClientAuthKey, errMissingCA)
+	}
+	_, err := newTLSSettings(cfg).serverConfig()
+	return err
+}
+
+// Segment size and fsync policy matter only when spool_dir is set.
+func validateSpool(cfg *FlowCfg) error {
+	if cfg.SpoolDir == "" {
+		return nil
+	}
+	if cfg.SpoolSegmentSize <= 0 {
+		return fmt.Errorf("%s %s", spoolSegmentSizeKey, errTooSmall)
+	}
+	if !strIn(validFsyncOptions, cfg.SpoolFsync) {
+		return fmt.Errorf("%s %s", spoolFsyncKey, errInvalidValue)
+	}
+	return nil
+}
+
+// IANA time zone name, Local or UTC.
+func validateTimezone(value string) error {
+	if _, err := time.LoadLocation(value); err != nil {
+		return errInvalidValue
+	}
+	return nil
+}
+
+// Octal file mode e.g. 0660. Empty value leaves default permissions.
+func validateSocketMode(value string) error {
+	if value == "" {
+		return nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return errInvalidValue
+	}
+	return nil
+}
+
+// Owner in user[:group] format. Empty value leaves default owner.
+func validateSocketOwner(value string) error {
+	if value == "" {
+		return nil
+	}
+	_, _, err := lookupOwner(value)
+	return err
+}
+
 /*
 http://docs.aws.amazon.com/AmazonCloudWatchLogs/latest/APIReference/API_CreateLogGroup.html
 Log group names can be between 1 and 512 characters long.
@@ -270,6 +746,182 @@ func validateQueueSize(value queue_size) error {
 	return nil
 }
 
+var byteSizeUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+}
+
+/*
+Parse size with optional unit suffix e.g. 512KB, 256MB. Units are powers of
+1024. Empty value means no limit and returns 0.
+*/
+func parseByteSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	digits := strings.TrimRightFunc(value, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	unit, ok := byteSizeUnits[strings.ToUpper(strings.TrimSpace(value[len(digits):]))]
+	if !ok {
+		return 0, errInvalidValue
+	}
+	size, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || size < 0 || size > math.MaxInt64/unit {
+		return 0, errInvalidValue
+	}
+	return size * unit, nil
+}
+
+func validateMultiline(cfg *FlowCfg) error {
+	if cfg.MultilineStart != "" && cfg.MultilineContinue != "" {
+		return fmt.Errorf("%s %s", multilineContKey, errConflictingPatterns)
+	}
+	if err := validatePattern(cfg.MultilineStart); err != nil {
+		return fmt.Errorf("%s %s", multilineStartKey, err)
+	}
+	if err := validatePattern(cfg.MultilineContinue); err != nil {
+		return fmt.Errorf("%s %s", multilineContKey, err)
+	}
+	if cfg.MultilineTimeout < minTimeout {
+		return fmt.Errorf("%s %s", multilineTimeoutKey, errTooSmall)
+	}
+	if _, err := parseByteSize(cfg.MultilineMaxSize); err != nil {
+		return fmt.Errorf("%s %s", multilineMaxSizeKey, err)
+	}
+	return nil
+}
+
+func validateRoute(cfg *RouteCfg) error {
+	if err := validateNameTemplate(cfg.Group, validateGroup); err != nil {
+		return keyError(groupKey, err)
+	}
+	if err := validateNameTemplate(cfg.Stream, validateStrean); err != nil {
+		return keyError(streamKey, err)
+	}
+	return validateFilter(&cfg.Filter)
+}
+
+/*
+Group and stream are templates. Names which depend on message fields are
+sanitized when rendered, the other ones are validated upfront.
+*/
+func validateNameTemplate(value string, validate func(string) error) error {
+	if value == "" {
+		return errEmptyValue
+	}
+	tpl, err := template.New("").Parse(value)
+	if err != nil {
+		return err
+	}
+	if isDynamic(tpl) {
+		return nil
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if err := tpl.Execute(buf, destinationVars{InstanceID: "i-0", AgentHostname: "localhost"}); err != nil {
+		return err
+	}
+	return validate(buf.String())
+}
+
+// Whether any destination of flow has group or stream depending on message fields.
+func hasDynamicNames(cfg *FlowCfg) bool {
+	names := []string{cfg.Group, cfg.Stream}
+	for _, route := range cfg.Routes {
+		names = append(names, route.Group, route.Stream)
+	}
+	for _, name := range names {
+		if tpl, err := template.New("").Parse(name); err == nil && isDynamic(tpl) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateFilter(cfg *FilterCfg) error {
+	if cfg.MinSeverity != "" {
+		if _, err := parseSeverity(cfg.MinSeverity); err != nil {
+			return fmt.Errorf("%s %s", minSeverityKey, err)
+		}
+	}
+	for key, names := range map[string][]string{
+		includeFacilitiesKey: cfg.IncludeFacilities,
+		excludeFacilitiesKey: cfg.ExcludeFacilities,
+	} {
+		for _, name := range names {
+			if _, err := parseFacility(name); err != nil {
+				return fmt.Errorf("%s %s", key, err)
+			}
+		}
+	}
+	for key, patterns := range map[string][]string{
+		includeTagsKey: cfg.IncludeTags,
+		excludeTagsKey: cfg.ExcludeTags,
+	} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s %s", key, err)
+			}
+		}
+	}
+	if err := validatePattern(cfg.IncludeMessages); err != nil {
+		return fmt.Errorf("%s %s", includeMessagesKey, err)
+	}
+	if err := validatePattern(cfg.ExcludeMessages); err != nil {
+		return fmt.Errorf("%s %s", excludeMessagesKey, err)
+	}
+	return nil
+}
+
+// Empty pattern is valid.
+func validatePattern(value string) error {
+	if value == "" {
+		return nil
+	}
+	_, err := regexp.Compile(value)
+	return err
+}
+
+// Marker must leave room for the message it is appended to.
+func validateOversize(cfg *FlowCfg) error {
+	if !strIn(validOversizeOptions, cfg.OversizedMessage) {
+		return fmt.Errorf("%s %s", oversizedMessageKey, errInvalidValue)
+	}
+	if len(cfg.TruncateMarker) > maxTruncateMarkerSize {
+		return fmt.Errorf("%s %s", truncateMarkerKey, errMarkerTooLong)
+	}
+	return nil
+}
+
+// Window narrower than margin would not accept any event.
+func validateWindow(cfg *FlowCfg) error {
+	if cfg.MaxEventAge != 0 && cfg.MaxEventAge <= windowMargin {
+		return fmt.Errorf("%s %s", maxEventAgeKey, errTooSmall)
+	}
+	if cfg.MaxEventFuture != 0 && cfg.MaxEventFuture <= windowMargin {
+		return fmt.Errorf("%s %s", maxEventFutureKey, errTooSmall)
+	}
+	if !strIn(validWindowOptions, cfg.OutOfWindow) {
+		return fmt.Errorf("%s %s", outOfWindowKey, errInvalidValue)
+	}
+	return nil
+}
+
+// Blocking on queue which can not hold any event would stop the flow forever.
+func validateOverflowPolicy(cfg *FlowCfg) error {
+	if !strIn(validOverflowPolicies, cfg.OverflowPolicy) {
+		return errInvalidValue
+	}
+	if cfg.OverflowPolicy == overflowBlock && cfg.QueueSize == 0 {
+		return errBlockingEmptyQueue
+	}
+	return nil
+}
+
 func validateUploadDelay(value upload_delay) error {
 	if value < minUploadDelay {
 		return errTooSmall
@@ -277,6 +929,13 @@ func validateUploadDelay(value upload_delay) error {
 	return nil
 }
 
+func validateIdleTimeout(value time.Duration) error {
+	if value < minTimeout {
+		return errTooSmall
+	}
+	return nil
+}
+
 func validateLogOutput(value string) error {
 	if value == "" {
 		return errEmptyValue
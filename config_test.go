@@ -1,7 +1,10 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -46,6 +49,11 @@ func TestValidateStream_invalid_strings(t *testing.T) {
 func TestValidateSource_ok(t *testing.T) {
 	for _, uri := range []string{
 		"udp://localhost:5514",
+		"tcp://localhost:5514",
+		"tls://localhost:6514",
+		"unixgram:///dev/log",
+		"unix:///run/app.sock",
+		"unix://app.sock",
 	} {
 		err := validateSource(uri)
 		assert.Nil(t, err)
@@ -54,7 +62,8 @@ func TestValidateSource_ok(t *testing.T) {
 
 func TestValidateSource_error(t *testing.T) {
 	for uri, expected := range map[string]error{
-		"tcp://localhost:5514": errInvalidScheme,
+		"http://localhost:5514": errInvalidScheme,
+		"unix://":               errEmptySocketPath,
 	} {
 		err := validateSource(uri)
 		assert.Equal(t, err, expected)
@@ -124,6 +133,298 @@ func Test_validateUploadDelay_too_small(t *testing.T) {
 	assert.Equal(t, errTooSmall, validateUploadDelay(1))
 }
 
+func Test_validateIdleTimeout(t *testing.T) {
+	assert.Nil(t, validateIdleTimeout(time.Minute))
+	assert.Equal(t, errTooSmall, validateIdleTimeout(time.Nanosecond))
+}
+
 func Test_validateQueueSize_ok(t *testing.T) {
 	assert.Nil(t, validateQueueSize(0))
 }
+
+func Test_validateSocketMode_ok(t *testing.T) {
+	for _, mode := range []string{"", "0660", "777"} {
+		assert.Nil(t, validateSocketMode(mode))
+	}
+}
+
+func Test_validateSocketMode_invalid(t *testing.T) {
+	for _, mode := range []string{"0999", "01777", "rw"} {
+		assert.Equal(t, errInvalidValue, validateSocketMode(mode))
+	}
+}
+
+func Test_validateSocketOwner_empty(t *testing.T) {
+	assert.Nil(t, validateSocketOwner(""))
+}
+
+func Test_validateTLS_ok(t *testing.T) {
+	pki, cleanup := newTestPKI(t)
+	defer cleanup()
+	cfg := &FlowCfg{
+		TLSCertFile:   pki.serverCert,
+		TLSKeyFile:    pki.serverKey,
+		TLSCAFile:     pki.caCert,
+		TLSClientAuth: true,
+	}
+	assert.Nil(t, validateTLS(cfg))
+}
+
+func Test_validateTLS_missing(t *testing.T) {
+	for expected, cfg := range map[string]*FlowCfg{
+		"tls_cert_file empty value":                              {TLSKeyFile: "key"},
+		"tls_key_file empty value":                               {TLSCertFile: "cert"},
+		"tls_client_auth client authentication requires CA file": {TLSCertFile: "cert", TLSKeyFile: "key", TLSClientAuth: true},
+	} {
+		assert.EqualError(t, validateTLS(cfg), expected)
+	}
+}
+
+func Test_validateTLS_invalid_ca(t *testing.T) {
+	pki, cleanup := newTestPKI(t)
+	defer cleanup()
+	cfg := &FlowCfg{
+		TLSCertFile: pki.serverCert,
+		TLSKeyFile:  pki.serverKey,
+		TLSCAFile:   pki.serverKey,
+	}
+	assert.Equal(t, errInvalidCA, validateTLS(cfg))
+}
+
+func Test_validateSyslogFormat_ok(t *testing.T) {
+	for _, format := range []string{formatRFC3164, formatRFC5424, formatRaw, formatJSON, formatAuto} {
+		assert.Nil(t, validateSyslogFormat(format))
+	}
+}
+
+func Test_validateTimezone_ok(t *testing.T) {
+	for _, name := range []string{"", "UTC", "Local", "Europe/Warsaw"} {
+		assert.Nil(t, validateTimezone(name))
+	}
+}
+
+func Test_validateTimezone_invalid(t *testing.T) {
+	assert.Equal(t, errInvalidValue, validateTimezone("Mars/Olympus_Mons"))
+}
+
+func Test_validateSpool_ok(t *testing.T) {
+	assert.Nil(t, validateSpool(&FlowCfg{}))
+	assert.Nil(t, validateSpool(&FlowCfg{SpoolDir: "/tmp", SpoolSegmentSize: 1, SpoolFsync: fsyncNeverOption}))
+}
+
+func Test_validateSpool_invalid(t *testing.T) {
+	for expected, cfg := range map[string]*FlowCfg{
+		"spool_segment_size too small value": {SpoolDir: "/tmp", SpoolFsync: fsyncNeverOption},
+		"spool_fsync invalid value":          {SpoolDir: "/tmp", SpoolSegmentSize: 1, SpoolFsync: "sometimes"},
+	} {
+		assert.EqualError(t, validateSpool(cfg), expected)
+	}
+}
+
+func Test_validateOverflowPolicy_ok(t *testing.T) {
+	for _, policy := range validOverflowPolicies {
+		assert.Nil(t, validateOverflowPolicy(&FlowCfg{QueueSize: 1, OverflowPolicy: policy}))
+	}
+}
+
+func Test_validateOverflowPolicy_invalid(t *testing.T) {
+	assert.Equal(t, errInvalidValue, validateOverflowPolicy(&FlowCfg{QueueSize: 1, OverflowPolicy: "drop_all"}))
+	assert.Equal(t, errBlockingEmptyQueue, validateOverflowPolicy(&FlowCfg{OverflowPolicy: overflowBlock}))
+}
+
+func Test_parseByteSize_ok(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"":      0,
+		"100":   100,
+		"10B":   10,
+		"512KB": 512 << 10,
+		"256MB": 256 << 20,
+		"2 gb":  2 << 30,
+	} {
+		size, err := parseByteSize(value)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, size, value)
+	}
+}
+
+func Test_parseByteSize_invalid(t *testing.T) {
+	for _, value := range []string{"MB", "10TB", "-1MB", "1.5GB", "99999999999999999GB"} {
+		_, err := parseByteSize(value)
+		assert.Equal(t, errInvalidValue, err, value)
+	}
+}
+
+func Test_validateWindow(t *testing.T) {
+	assert.Nil(t, validateWindow(&FlowCfg{OutOfWindow: windowDropOption}))
+	assert.Nil(t, validateWindow(&FlowCfg{MaxEventAge: time.Hour, MaxEventFuture: time.Hour, OutOfWindow: windowClampOption}))
+	assert.EqualError(t, validateWindow(&FlowCfg{MaxEventAge: time.Second, OutOfWindow: windowDropOption}), "max_event_age too small value")
+	assert.EqualError(t, validateWindow(&FlowCfg{OutOfWindow: "keep"}), "out_of_window invalid value")
+}
+
+func Test_validateOversize(t *testing.T) {
+	assert.Nil(t, validateOversize(&FlowCfg{OversizedMessage: oversizeSplitOption}))
+	assert.EqualError(t, validateOversize(&FlowCfg{OversizedMessage: "ignore"}), "oversized_message invalid value")
+	cfg := &FlowCfg{OversizedMessage: oversizeTruncateOption, TruncateMarker: RandomString(maxTruncateMarkerSize + 1)}
+	assert.EqualError(t, validateOversize(cfg), "truncate_marker marker too long")
+}
+
+func Test_validateMultiline(t *testing.T) {
+	assert.Nil(t, validateMultiline(&FlowCfg{MultilineStart: `^\S`, MultilineTimeout: time.Second}))
+	for expected, cfg := range map[string]*FlowCfg{
+		"multiline_continue only one of multiline_start and multiline_continue may be set": {MultilineStart: "a", MultilineContinue: "b", MultilineTimeout: time.Second},
+		"multiline_start error parsing regexp: missing closing ): `(`":                     {MultilineStart: "(", MultilineTimeout: time.Second},
+		"multiline_timeout too small value":                                                {},
+		"multiline_max_size invalid value":                                                 {MultilineTimeout: time.Second, MultilineMaxSize: "big"},
+	} {
+		assert.EqualError(t, validateMultiline(cfg), expected)
+	}
+	assert.EqualError(t, validateMultiline(&FlowCfg{MultilineTimeout: time.Nanosecond}), "multiline_timeout too small value")
+}
+
+func Test_validateFilter(t *testing.T) {
+	assert.Nil(t, validateFilter(&FilterCfg{MinSeverity: "info", IncludeFacilities: []string{"auth"}, IncludeTags: []string{"app*"}}))
+	for expected, cfg := range map[string]*FilterCfg{
+		"min_severity invalid value":                                     {MinSeverity: "verbose"},
+		"exclude_facilities invalid value":                               {ExcludeFacilities: []string{"printer"}},
+		"include_tags syntax error in pattern":                           {IncludeTags: []string{"[app"}},
+		"exclude_messages error parsing regexp: missing closing ]: `[a`": {ExcludeMessages: "[a"},
+	} {
+		assert.EqualError(t, validateFilter(cfg), expected)
+	}
+}
+
+func Test_GetFlows_routes(t *testing.T) {
+	file, remove := tempConfig(t, "config.ini", `
+[app]
+group = app
+stream = all
+[route:app.errors]
+group = app
+stream = errors
+min_severity = err
+[app.logs]
+group = app
+stream = logs
+`)
+	defer remove()
+	cfg := NewConfig(file)
+	flows := cfg.GetFlows()
+	assert.Equal(t, 2, len(flows))
+	assert.Equal(t, "app", flows[0].Name)
+	assert.Equal(t, []*RouteCfg{{Name: "errors", Group: "app", Stream: "errors", Filter: FilterCfg{MinSeverity: "err"}}}, flows[0].Routes)
+	assert.Equal(t, "app.logs", flows[1].Name)
+	assert.Empty(t, flows[1].Routes)
+}
+
+func Test_mapFlows_route_errors(t *testing.T) {
+	file, remove := tempConfig(t, "config.ini", `
+[app]
+group = app
+stream = all
+[route:app]
+group = app
+[route:web.errors]
+group = web
+[route:main.errors]
+group = main
+[route:app.errors]
+group = app
+source = udp://localhost:5514
+`)
+	defer remove()
+	cfg := NewConfig(file)
+	_, errs := cfg.(*IniConfig).mapFlows()
+	assert.EqualError(t, errs, `[route:app] route section must be named route:flow.name
+[route:web.errors] route of unknown flow web
+[route:main.errors] route of unknown flow main
+[route:app.errors] source not allowed in route section`)
+}
+
+func Test_destinations(t *testing.T) {
+	flow := &FlowCfg{
+		Name:     "app",
+		Group:    "app",
+		Stream:   "all",
+		SpoolDir: "/var/spool/app",
+		Filter:   FilterCfg{MinSeverity: "info"},
+		Routes:   []*RouteCfg{{Name: "errors", Group: "app", Stream: "errors", Filter: FilterCfg{MinSeverity: "err"}}},
+	}
+	dsts := flow.destinations()
+	assert.Equal(t, 2, len(dsts))
+	assert.Equal(t, "route:app.errors", dsts[0].Name)
+	assert.Equal(t, "errors", dsts[0].Stream)
+	assert.Equal(t, "/var/spool/app/errors", dsts[0].SpoolDir)
+	assert.Equal(t, FilterCfg{MinSeverity: "err"}, dsts[0].Filter)
+	assert.Equal(t, "all", dsts[1].Stream)
+	assert.Equal(t, "/var/spool/app", dsts[1].SpoolDir)
+	assert.Equal(t, FilterCfg{}, dsts[1].Filter)
+}
+
+func Test_validateRoute(t *testing.T) {
+	assert.Nil(t, validateRoute(&RouteCfg{Group: "group", Stream: "stream"}))
+	assert.EqualError(t, validateRoute(&RouteCfg{Group: "group"}), "stream empty value")
+}
+
+func Test_validateNameTemplate(t *testing.T) {
+	assert.Nil(t, validateNameTemplate("{{.Hostname}}:{{.Syslogtag}}", validateStrean))
+	assert.Nil(t, validateNameTemplate("logs-{{.InstanceID}}", validateStrean))
+	assert.Equal(t, errInvalidValue, validateNameTemplate("logs:{{.InstanceID}}", validateStrean))
+	assert.Equal(t, errEmptyValue, validateNameTemplate("", validateGroup))
+	assert.NotNil(t, validateNameTemplate("{{.Hostname", validateGroup))
+}
+
+func Test_hasDynamicNames(t *testing.T) {
+	assert.False(t, hasDynamicNames(&FlowCfg{Group: "app", Stream: "{{.InstanceID}}"}))
+	assert.True(t, hasDynamicNames(&FlowCfg{Group: "app", Stream: "logs", Routes: []*RouteCfg{{Group: "app", Stream: "{{.Hostname}}"}}}))
+}
+
+func Test_expandEnv(t *testing.T) {
+	os.Setenv("GOFORWARD_TEST_GROUP", "app")
+	defer os.Unsetenv("GOFORWARD_TEST_GROUP")
+	for value, expected := range map[string]string{
+		"${GOFORWARD_TEST_GROUP}/logs":        "app/logs",
+		"${GOFORWARD_TEST_GROUP:-other}":      "app",
+		"${GOFORWARD_TEST_UNSET:-5514}":       "5514",
+		"${GOFORWARD_TEST_UNSET:-}":           "",
+		"$GOFORWARD_TEST_GROUP {{.Hostname}}": "$GOFORWARD_TEST_GROUP {{.Hostname}}",
+	} {
+		expanded, err := expandEnv(value)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, expanded)
+	}
+	_, err := expandEnv("${GOFORWARD_TEST_UNSET}")
+	assert.EqualError(t, err, "environment variable not set: GOFORWARD_TEST_UNSET")
+}
+
+func Test_LoadConfig_include(t *testing.T) {
+	file, remove := tempConfig(t,
+		"main.cfg", "[main]\ninclude = conf.d/*.cfg\n[app]\ngroup = app\n",
+		"conf.d/a.cfg", "[web]\ngroup = web\n",
+		"conf.d/b.cfg", "[route:web.errors]\ngroup = errors\n",
+	)
+	defer remove()
+	cfg, err := LoadConfig(file)
+	assert.Nil(t, err)
+	flows, errs := cfg.(*IniConfig).mapFlows()
+	assert.Empty(t, errs)
+	assert.Equal(t, 2, len(flows))
+	assert.Equal(t, "web", flows[1].Name)
+	assert.Equal(t, "errors", flows[1].Routes[0].Name)
+}
+
+func Test_LoadConfig_include_duplicate(t *testing.T) {
+	file, remove := tempConfig(t,
+		"main.cfg", "[main]\ninclude = *.inc\n[app]\ngroup = app\n",
+		"app.inc", "[app]\ngroup = other\n",
+	)
+	defer remove()
+	_, err := LoadConfig(file)
+	assert.EqualError(t, err, "[app] duplicate section in "+filepath.Join(filepath.Dir(file), "app.inc"))
+}
+
+func Test_LoadConfig_unset_variable(t *testing.T) {
+	file, remove := tempConfig(t, "main.cfg", "[app]\ngroup = ${GOFORWARD_TEST_UNSET}\n")
+	defer remove()
+	_, err := LoadConfig(file)
+	assert.EqualError(t, err, "[app] group environment variable not set: GOFORWARD_TEST_UNSET")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultIdleTimeout = 15 * time.Minute
+	maxNameLength      = 512
+	groupNameChars     = "_-/.abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// Variables available in group and stream templates.
+type destinationVars struct {
+	syslogMessage
+	// Agent host variables.
+	InstanceID    string
+	AgentHostname string
+}
+
+func newDestinationVars(msg syslogMessage, agent streamVars) destinationVars {
+	return destinationVars{syslogMessage: msg, InstanceID: agent.InstanceID, AgentHostname: agent.Hostname}
+}
+
+/*
+Uploaders of a single route, one per group and stream rendered from message.
+Uploader is started on first event sent to its group and stream. When names
+depend on message fields, uploaders which got no events for idle timeout are
+stopped. Otherwise there is only one uploader started upfront.
+*/
+type destinationCache struct {
+	cfg       *FlowCfg
+	group     *template.Template
+	stream    *template.Template
+	dynamic   bool
+	agent     streamVars
+	uploaders map[string]*uploader
+	buf       *bytes.Buffer
+	// Running uploaders
+	wg *sync.WaitGroup
+}
+
+type uploader struct {
+	in chan logEvent
+	// When last event was sent.
+	used time.Time
+}
+
+// Templates are expected to be validated.
+func newDestinationCache(cfg *FlowCfg, agent streamVars, wg *sync.WaitGroup) (*destinationCache, error) {
+	cache := &destinationCache{
+		cfg:       cfg,
+		group:     template.Must(template.New("").Parse(cfg.Group)),
+		stream:    template.Must(template.New("").Parse(cfg.Stream)),
+		agent:     agent,
+		uploaders: make(map[string]*uploader),
+		buf:       bytes.NewBuffer([]byte{}),
+		wg:        wg,
+	}
+	cache.dynamic = isDynamic(cache.group) || isDynamic(cache.stream)
+	if !cache.dynamic {
+		if _, err := cache.get(syslogMessage{}, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return cache, nil
+}
+
+func (c *destinationCache) send(msg syslogMessage, event logEvent) {
+	now := time.Now()
+	up, err := c.get(msg, now)
+	if err != nil {
+		log.Errorf("could not create queue: %s", err)
+		return
+	}
+	up.in <- event
+	up.used = now
+}
+
+// Return uploader of message group and stream, start it when needed.
+func (c *destinationCache) get(msg syslogMessage, now time.Time) (*uploader, error) {
+	group, stream := c.resolve(msg)
+	key := group + ":" + stream
+	if up, ok := c.uploaders[key]; ok {
+		return up, nil
+	}
+	cfg := *c.cfg
+	cfg.Group, cfg.Stream = group, stream
+	queue, err := newQueue(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	up := &uploader{in: make(chan logEvent), used: now}
+	c.uploaders[key] = up
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		recToDst(up.in, &cfg, queue)
+	}()
+	return up, nil
+}
+
+// Return group and stream names of message.
+func (c *destinationCache) resolve(msg syslogMessage) (group, stream string) {
+	vars := newDestinationVars(msg, c.agent)
+	group = sanitizeGroup(c.render(c.group, vars))
+	stream = sanitizeStream(c.render(c.stream, vars))
+	return
+}
+
+func (c *destinationCache) render(tpl *template.Template, vars destinationVars) string {
+	c.buf.Reset()
+	tpl.Execute(c.buf, vars)
+	return c.buf.String()
+}
+
+// Stop uploaders which got no events for idle timeout. They upload remaining events before exit.
+func (c *destinationCache) evict(now time.Time) {
+	if !c.dynamic {
+		return
+	}
+	for key, up := range c.uploaders {
+		if now.Sub(up.used) >= c.cfg.IdleTimeout {
+			log.Debugf("%s idle, stopping", key)
+			close(up.in)
+			delete(c.uploaders, key)
+		}
+	}
+}
+
+func (c *destinationCache) close() {
+	for key, up := range c.uploaders {
+		close(up.in)
+		delete(c.uploaders, key)
+	}
+}
+
+// Whether template output depends on message fields.
+func isDynamic(tpl *template.Template) bool {
+	return usesField(tpl, func(field string) bool { return !agentVars[field] })
+}
+
+// Agent variables are the same for every message.
+var agentVars = map[string]bool{"InstanceID": true, "AgentHostname": true}
+
+// Whether template refers to field accepted by match. Whole data passed by dot is matched as "".
+func usesField(tpl *template.Template, match func(field string) bool) bool {
+	return tpl.Tree != nil && walkFields(tpl.Tree.Root, match)
+}
+
+// Walk template nodes looking for fields accepted by match.
+func walkFields(node parse.Node, match func(string) bool) bool {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return false
+		}
+		for _, child := range node.Nodes {
+			if walkFields(child, match) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return walkFields(node.Pipe, match)
+	case *parse.PipeNode:
+		if node == nil {
+			return false
+		}
+		for _, cmd := range node.Cmds {
+			if walkFields(cmd, match) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range node.Args {
+			if walkFields(arg, match) {
+				return true
+			}
+		}
+	case *parse.IfNode:
+		return walkFields(node.Pipe, match) || walkFields(node.List, match) || walkFields(node.ElseList, match)
+	case *parse.RangeNode:
+		return walkFields(node.Pipe, match) || walkFields(node.List, match) || walkFields(node.ElseList, match)
+	case *parse.WithNode:
+		return walkFields(node.Pipe, match) || walkFields(node.List, match) || walkFields(node.ElseList, match)
+	case *parse.TemplateNode:
+		return walkFields(node.Pipe, match)
+	case *parse.ChainNode:
+		return walkFields(node.Node, match)
+	case *parse.FieldNode:
+		return match(node.Ident[0])
+	case *parse.VariableNode:
+		// Only $ refers to template data.
+		if node.Ident[0] != "$" {
+			return false
+		}
+		if len(node.Ident) == 1 {
+			return match("")
+		}
+		return match(node.Ident[1])
+	case *parse.DotNode:
+		return match("")
+	}
+	return false
+}
+
+// Replace characters not allowed in group name.
+func sanitizeGroup(name string) string {
+	return sanitizeName(strings.Map(func(r rune) rune {
+		if !strings.ContainsRune(groupNameChars, r) {
+			return '_'
+		}
+		return r
+	}, name))
+}
+
+// Replace characters not allowed in stream name.
+func sanitizeStream(name string) string {
+	return sanitizeName(strings.Map(func(r rune) rune {
+		if r == ':' || r == '*' {
+			return '_'
+		}
+		return r
+	}, name))
+}
+
+func sanitizeName(name string) string {
+	if name == "" {
+		return "UNKNOWN"
+	}
+	if len(name) > maxNameLength {
+		name = name[:utf8Prefix(name, maxNameLength)]
+	}
+	return name
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_isDynamic(t *testing.T) {
+	for format, expected := range map[string]bool{
+		"logs":                               false,
+		"{{.InstanceID}}-{{.AgentHostname}}": false,
+		"{{.Hostname}}/{{.Syslogtag}}":       true,
+		"{{if .Program}}app{{end}}":          true,
+		`{{index .StructuredData "a" "b"}}`:  true,
+		"{{$.Fields.service}}":               true,
+		"{{.}}":                              true,
+	} {
+		tpl := template.Must(template.New("").Parse(format))
+		assert.Equal(t, expected, isDynamic(tpl), format)
+	}
+}
+
+func Test_usesField(t *testing.T) {
+	isHostname := func(field string) bool { return field == "Hostname" }
+	for format, expected := range map[string]bool{
+		"{{.AgentHostname}}":                false,
+		"{{.Program}}/{{$.Hostname}}":       true,
+		"{{with .Program}}{{end}}":          false,
+		"{{if .Hostname}}a{{else}}b{{end}}": true,
+		"{{.}}":                             false,
+	} {
+		tpl := template.Must(template.New("").Parse(format))
+		assert.Equal(t, expected, usesField(tpl, isHostname), format)
+	}
+}
+
+func Test_destinationCache_resolve(t *testing.T) {
+	cache := &destinationCache{
+		group:  template.Must(template.New("").Parse("apps/{{.Program}}")),
+		stream: template.Must(template.New("").Parse("{{.Hostname}}/{{.Syslogtag}}")),
+		agent:  streamVars{InstanceID: "i-1", Hostname: "agent"},
+		buf:    bytes.NewBuffer([]byte{}),
+	}
+	group, stream := cache.resolve(syslogMessage{Hostname: "web1", Syslogtag: "nginx[12]:", Program: "nginx"})
+	assert.Equal(t, "apps/nginx", group)
+	assert.Equal(t, "web1/nginx[12]_", stream)
+}
+
+func Test_destinationCache_resolve_agent(t *testing.T) {
+	cache := &destinationCache{
+		group:  template.Must(template.New("").Parse("{{.AgentHostname}}")),
+		stream: template.Must(template.New("").Parse("{{.InstanceID}}")),
+		agent:  streamVars{InstanceID: "i-1", Hostname: "agent"},
+		buf:    bytes.NewBuffer([]byte{}),
+	}
+	group, stream := cache.resolve(syslogMessage{})
+	assert.Equal(t, "agent", group)
+	assert.Equal(t, "i-1", stream)
+}
+
+func Test_sanitizeGroup(t *testing.T) {
+	assert.Equal(t, "app_web_1", sanitizeGroup("app web:1"))
+	assert.Equal(t, "UNKNOWN", sanitizeGroup(""))
+}
+
+func Test_sanitizeStream(t *testing.T) {
+	assert.Equal(t, "host/tag_", sanitizeStream("host/tag:"))
+	assert.Equal(t, maxNameLength, len(sanitizeStream(strings.Repeat("a", maxNameLength+1))))
+}
+
+// Assert that only uploaders of dynamic names are evicted.
+func Test_destinationCache_evict(t *testing.T) {
+	in := make(chan logEvent)
+	cache := &destinationCache{
+		cfg:       &FlowCfg{IdleTimeout: time.Minute},
+		uploaders: map[string]*uploader{"group:stream": {in: in, used: time.Now()}},
+	}
+	cache.evict(time.Now().Add(time.Hour))
+	assert.Equal(t, 1, len(cache.uploaders))
+	cache.dynamic = true
+	cache.evict(time.Now())
+	assert.Equal(t, 1, len(cache.uploaders))
+	cache.evict(time.Now().Add(time.Hour))
+	assert.Empty(t, cache.uploaders)
+	_, opened := <-in
+	assert.False(t, opened)
+}
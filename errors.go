@@ -14,4 +14,22 @@ var (
 	errInvalidScheme        = errors.New("invalid network scheme")
 	errInvalidFormat        = errors.New("invalid format")
 	errTooSmall             = errors.New("too small value")
+	errNotSocket            = errors.New("file exists and is not a socket")
+	errAddressInUse         = errors.New("address in use")
+	errEmptySocketPath      = errors.New("empty socket path")
+	errInvalidCA            = errors.New("no certificates found in CA file")
+	errMissingCA            = errors.New("client authentication requires CA file")
+	errCorruptedRecord      = errors.New("corrupted spool record")
+	errDuplicateSpoolDir    = errors.New("spool directory used by more than one flow")
+	errBlockingEmptyQueue   = errors.New("block policy requires queue_size greater than 0")
+	errMarkerTooLong        = errors.New("marker too long")
+	errDynamicSpool         = errors.New("can not be used with group or stream depending on message")
+	errConflictingPatterns  = errors.New("only one of multiline_start and multiline_continue may be set")
+	errDuplicateSection     = errors.New("duplicate section")
+	errUnsetVariable        = errors.New("environment variable not set")
+	errUnknownSection       = errors.New("unknown section")
+	errMappingExpected      = errors.New("mapping expected")
+	errInvalidRouteSection  = errors.New("route section must be named route:flow.name")
+	errUnknownFlow          = errors.New("route of unknown flow")
+	errNotRouteOption       = errors.New("not allowed in route section")
 )
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Decides which messages are sent. Message is sent when it is at least as
+severe as min severity, its facility and tag are included (when include
+lists are set) and not excluded, and its text matches include pattern
+(when set) and does not match exclude pattern.
+*/
+type messageFilter struct {
+	maxSeverity       SyslogSeverity
+	includeFacilities map[SyslogFacility]bool
+	excludeFacilities map[SyslogFacility]bool
+	includeTags       []string
+	excludeTags       []string
+	include           *regexp.Regexp
+	exclude           *regexp.Regexp
+}
+
+// Filter options are expected to be validated.
+func newFilter(cfg *FilterCfg) *messageFilter {
+	filter := &messageFilter{
+		maxSeverity:       logDebug,
+		includeFacilities: facilitySet(cfg.IncludeFacilities),
+		excludeFacilities: facilitySet(cfg.ExcludeFacilities),
+		includeTags:       cfg.IncludeTags,
+		excludeTags:       cfg.ExcludeTags,
+	}
+	if cfg.MinSeverity != "" {
+		filter.maxSeverity, _ = parseSeverity(cfg.MinSeverity)
+	}
+	if cfg.IncludeMessages != "" {
+		filter.include = regexp.MustCompile(cfg.IncludeMessages)
+	}
+	if cfg.ExcludeMessages != "" {
+		filter.exclude = regexp.MustCompile(cfg.ExcludeMessages)
+	}
+	return filter
+}
+
+func facilitySet(names []string) map[SyslogFacility]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[SyslogFacility]bool)
+	for _, name := range names {
+		facility, _ := parseFacility(name)
+		set[facility] = true
+	}
+	return set
+}
+
+func (f *messageFilter) match(msg syslogMessage) bool {
+	// Lower value means more severe message.
+	if msg.Severity > f.maxSeverity {
+		return false
+	}
+	if f.includeFacilities != nil && !f.includeFacilities[msg.Facility] {
+		return false
+	}
+	if f.excludeFacilities[msg.Facility] {
+		return false
+	}
+	tag := msg.tag()
+	if len(f.includeTags) > 0 && !matchAny(f.includeTags, tag) {
+		return false
+	}
+	if matchAny(f.excludeTags, tag) {
+		return false
+	}
+	if f.include != nil && !f.include.MatchString(msg.Message) {
+		return false
+	}
+	if f.exclude != nil && f.exclude.MatchString(msg.Message) {
+		return false
+	}
+	return true
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept severity name e.g. warning or its number.
+func parseSeverity(value string) (SyslogSeverity, error) {
+	for severity, name := range severityMap {
+		if strings.EqualFold(name, value) {
+			return severity, nil
+		}
+	}
+	num, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || num > uint64(logDebug) {
+		return 0, errInvalidValue
+	}
+	return SyslogSeverity(num), nil
+}
+
+// Accept facility name e.g. local0 or its number.
+func parseFacility(value string) (SyslogFacility, error) {
+	for facility, name := range facilityMap {
+		if strings.EqualFold(name, value) {
+			return facility, nil
+		}
+	}
+	num, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || num > uint64(logLocal7) {
+		return 0, errInvalidValue
+	}
+	return SyslogFacility(num), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_messageFilter_empty(t *testing.T) {
+	assert.True(t, newFilter(&FilterCfg{}).match(syslogMessage{Severity: logDebug}))
+}
+
+func Test_messageFilter_severity(t *testing.T) {
+	filter := newFilter(&FilterCfg{MinSeverity: "warning"})
+	assert.True(t, filter.match(syslogMessage{Severity: logErr}))
+	assert.True(t, filter.match(syslogMessage{Severity: logWarning}))
+	assert.False(t, filter.match(syslogMessage{Severity: logDebug}))
+}
+
+func Test_messageFilter_facilities(t *testing.T) {
+	filter := newFilter(&FilterCfg{IncludeFacilities: []string{"auth", "local0"}, ExcludeFacilities: []string{"local0"}})
+	assert.True(t, filter.match(syslogMessage{Facility: logAuth}))
+	assert.False(t, filter.match(syslogMessage{Facility: logLocal0}))
+	assert.False(t, filter.match(syslogMessage{Facility: logCron}))
+}
+
+func Test_messageFilter_tags(t *testing.T) {
+	filter := newFilter(&FilterCfg{IncludeTags: []string{"nginx*", "app"}, ExcludeTags: []string{"nginx-debug"}})
+	assert.True(t, filter.match(syslogMessage{Program: "nginx"}))
+	assert.True(t, filter.match(syslogMessage{AppName: "app"}))
+	assert.False(t, filter.match(syslogMessage{Program: "nginx-debug"}))
+	assert.False(t, filter.match(syslogMessage{Program: "sshd"}))
+}
+
+func Test_messageFilter_messages(t *testing.T) {
+	filter := newFilter(&FilterCfg{IncludeMessages: "ERROR|WARN", ExcludeMessages: "healthcheck"})
+	assert.True(t, filter.match(syslogMessage{Message: "ERROR failed"}))
+	assert.False(t, filter.match(syslogMessage{Message: "ERROR healthcheck failed"}))
+	assert.False(t, filter.match(syslogMessage{Message: "INFO started"}))
+}
+
+func Test_parseSeverity(t *testing.T) {
+	for value, expected := range map[string]SyslogSeverity{"ERR": logErr, "debug": logDebug, "4": logWarning} {
+		severity, err := parseSeverity(value)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, severity, value)
+	}
+	_, err := parseSeverity("8")
+	assert.Equal(t, errInvalidValue, err)
+}
+
+func Test_parseFacility(t *testing.T) {
+	facility, err := parseFacility("Local7")
+	assert.Nil(t, err)
+	assert.Equal(t, logLocal7, facility)
+	_, err = parseFacility("local8")
+	assert.Equal(t, errInvalidValue, err)
+}
+
+// Assert that message is sent to first route which accepts it.
+func Test_selectRoute(t *testing.T) {
+	errors, all := &destinationCache{}, &destinationCache{}
+	routes := []route{
+		{filter: newFilter(&FilterCfg{MinSeverity: "err"}), dsts: errors},
+		{filter: newFilter(&FilterCfg{}), dsts: all},
+	}
+	dsts, ok := selectRoute(routes, syslogMessage{Severity: logCrit})
+	assert.True(t, ok)
+	assert.True(t, dsts == errors)
+	dsts, _ = selectRoute(routes, syslogMessage{Severity: logInfo})
+	assert.True(t, dsts == all)
+}
@@ -1,7 +1,20 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
 	"time"
 
 	"github.com/go-ini/ini"
@@ -35,3 +48,115 @@ var testPriorities = []TestSyslogPriority{
 	{severity: logEmerg, facility: logKern, priority: SyslogPriority(0)},
 	{severity: logAlert, facility: logUser, priority: SyslogPriority(9)},
 }
+
+type testPKI struct {
+	caCert       string
+	serverCert   string
+	serverKey    string
+	clientConfig *tls.Config
+}
+
+// Create CA, server and client certificates. CA and server files are written to temporary directory.
+func newTestPKI(t *testing.T) (*testPKI, func()) {
+	dir, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, caDER := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	ca, _ := x509.ParseCertificate(caDER)
+	serverKey, serverDER := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	clientKey, clientDER := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		DNSNames:     []string{"client.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	pki := &testPKI{
+		caCert:     writePEM(t, dir, "ca.pem", "CERTIFICATE", caDER),
+		serverCert: writePEM(t, dir, "server.pem", "CERTIFICATE", serverDER),
+		serverKey:  writePEM(t, dir, "server.key", "EC PRIVATE KEY", marshalKey(t, serverKey)),
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	pki.clientConfig = &tls.Config{
+		RootCAs: roots,
+		Certificates: []tls.Certificate{
+			{Certificate: [][]byte{clientDER}, PrivateKey: clientKey},
+		},
+	}
+	return pki, func() { os.RemoveAll(dir) }
+}
+
+// Sign certificate with parent key. Self signed certificate is created when parent is nil.
+func newTestCert(t *testing.T, tpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, der
+}
+
+func marshalKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+/*
+Write config files given as name and content pairs to temporary directory.
+Names may contain subdirectories. Returns path of the first file and function
+removing the directory.
+*/
+func tempConfig(t *testing.T, name, content string, more ...string) (string, func()) {
+	if len(more)%2 != 0 {
+		t.Fatal("config file without content")
+	}
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := append([]string{name, content}, more...)
+	for i := 0; i < len(files); i += 2 {
+		path := filepath.Join(dir, files[i])
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(files[i+1]), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, name), func() { os.RemoveAll(dir) }
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"reflect"
 	"sync"
 	"syscall"
 	"text/template"
@@ -20,7 +21,6 @@ import (
 )
 
 var version string
-var wg = &sync.WaitGroup{}
 var cwlogs *cloudwatchlogs.CloudWatchLogs
 var ec2meta *ec2metadata.EC2Metadata
 
@@ -38,11 +38,22 @@ func usage() {
 func main() {
 	flag.Usage = usage
 	cfgfile := flag.String("c", defaultConfigFile, "Config file location.")
+	check := flag.Bool("t", false, "Check config file and exit. Same as check command.")
 	flag.Parse()
+	switch {
+	case *check || flag.Arg(0) == "check":
+		os.Exit(checkConfig(*cfgfile, os.Stdout))
+	case flag.Arg(0) == "convert":
+		if err := convertConfig(*cfgfile, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	log.SetFormatter(&programFormat{})
 	log.SetOutput(os.Stderr)
 	log.SetLevel(log.ErrorLevel)
-	config := NewIniConfig(*cfgfile)
+	config := NewConfig(*cfgfile)
 	if err := config.Validate(); err != nil {
 		log.Fatal(err)
 	}
@@ -53,17 +64,99 @@ func main() {
 	hook := pickHook(strToOutput[settings.LogOutput])
 	log.AddHook(hook)
 	log.SetLevel(strToLevel[settings.LogLevel])
-	receivers := setupFlows(flows)
+	agent := getStreamVars()
+	running := setupFlows(flows, agent)
+	var stopped []*runningFlow
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
-	select {
-	case <-signals:
-		log.Infof("got SIGINT/SIGTERM")
-		break
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Infof("got SIGINT/SIGTERM")
+			break
+		}
+		log.Infof("got SIGHUP, reloading %s", *cfgfile)
+		flows, err := loadFlows(*cfgfile)
+		if err != nil {
+			log.Errorf("keeping current configuration: %s", err)
+			continue
+		}
+		var drained []*runningFlow
+		running, drained = reloadFlows(running, flows, agent)
+		stopped = append(stopped, drained...)
 	}
-	closeAll(receivers)
-	log.Debugf("waiting for upload to finish")
-	wg.Wait()
+	closeAll(running, stopped)
+}
+
+// Read and validate flows of config file.
+func loadFlows(file string) ([]*FlowCfg, error) {
+	config, err := LoadConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config.GetFlows(), nil
+}
+
+// Return flows which are no longer configured or changed and configs of flows to start.
+func diffFlows(running map[string]*runningFlow, flows []*FlowCfg) (stop []*runningFlow, start []*FlowCfg) {
+	configured := make(map[string]bool)
+	for _, flow := range flows {
+		configured[flow.Name] = true
+		current, ok := running[flow.Name]
+		if ok && reflect.DeepEqual(current.cfg, flow) {
+			continue
+		}
+		if ok {
+			stop = append(stop, current)
+		}
+		start = append(start, flow)
+	}
+	for name, current := range running {
+		if !configured[name] {
+			stop = append(stop, current)
+		}
+	}
+	return
+}
+
+/*
+Apply new flows. Unchanged flows keep running, removed and changed ones are
+stopped before new ones are started so their sockets and spool directories
+are released. Flow which fails to start is logged and its old version, if
+any, is started again. Returns running flows and stopped ones which may
+still upload queued events.
+*/
+func reloadFlows(running map[string]*runningFlow, flows []*FlowCfg, agent streamVars) (map[string]*runningFlow, []*runningFlow) {
+	stop, start := diffFlows(running, flows)
+	old := make(map[string]*FlowCfg)
+	for _, flow := range stop {
+		log.Infof("stopping flow %s", flow.cfg.Name)
+		flow.stop()
+		if flow.cfg.SpoolDir != "" {
+			flow.wait()
+		}
+		old[flow.cfg.Name] = flow.cfg
+		delete(running, flow.cfg.Name)
+	}
+	for _, flow := range start {
+		log.Infof("starting flow %s", flow.Name)
+		started, err := startFlow(flow, agent)
+		if err != nil {
+			log.Errorf("could not start flow %s: %s", flow.Name, err)
+			prev, ok := old[flow.Name]
+			if !ok {
+				continue
+			}
+			if started, err = startFlow(prev, agent); err != nil {
+				log.Errorf("could not restart flow %s: %s", flow.Name, err)
+				continue
+			}
+		}
+		running[flow.Name] = started
+	}
+	return running, stop
 }
 
 func setServices() {
@@ -77,72 +170,194 @@ func setServices() {
 	ec2meta = ec2metadata.New(sess)
 }
 
-func closeAll(receivers []receiver) {
+// Stop all flows and wait until their events are uploaded or spooled.
+func closeAll(flows map[string]*runningFlow, stopped []*runningFlow) {
 	log.Info("closing connections")
-	for _, receiver := range receivers {
-		receiver.Close()
+	for _, flow := range flows {
+		flow.stop()
+		stopped = append(stopped, flow)
+	}
+	log.Debugf("waiting for upload to finish")
+	for _, flow := range stopped {
+		flow.wait()
 	}
 }
 
-func setupFlows(flows []*FlowCfg) (receivers []receiver) {
+func setupFlows(flows []*FlowCfg, agent streamVars) map[string]*runningFlow {
 	log.Debug("seting flow")
+	running := make(map[string]*runningFlow)
 	for _, flow := range flows {
-		receiver := newReceiver(flow.Source)
-		receivers = append(receivers, receiver)
-		if err := receiver.Listen(); err != nil {
-			closeAll(receivers)
+		started, err := startFlow(flow, agent)
+		if err != nil {
+			closeAll(running, nil)
 			log.Fatal(err)
 		}
-		in := receiver.Receive()
-		out := make(chan logEvent)
-		format, _ := template.New("").Parse(flow.CloudwatchFormat)
-		go convertEvents(in, out, parserFunctions[flow.SyslogFormat], format)
-		wg.Add(1)
-		go recToDst(out, flow)
+		running[flow.Name] = started
 	}
-	return
+	return running
 }
 
-// Parse, filter incoming messages and send them to destination.
-func convertEvents(in <-chan string, out chan<- logEvent, parsefn syslogParser, tpl *template.Template) {
-	defer close(out)
-	buf := bytes.NewBuffer([]byte{})
-	for msg := range in {
-		parsed, err := parsefn(msg)
+// Listener and uploaders of a single flow.
+type runningFlow struct {
+	cfg      *FlowCfg
+	receiver receiver
+	// Converting and uploading goroutines
+	wg *sync.WaitGroup
+}
+
+// Start listening and uploading events of flow.
+func startFlow(flow *FlowCfg, agent streamVars) (*runningFlow, error) {
+	receiver := newReceiver(flow)
+	if err := receiver.Listen(); err != nil {
+		return nil, err
+	}
+	running := &runningFlow{cfg: flow, receiver: receiver, wg: &sync.WaitGroup{}}
+	var routes []route
+	for _, dst := range flow.destinations() {
+		cache, err := newDestinationCache(dst, agent, running.wg)
 		if err != nil {
-			continue
+			receiver.Close()
+			for _, r := range routes {
+				r.dsts.close()
+			}
+			running.wait()
+			return nil, err
 		}
-		err = parsed.render(tpl, buf)
-		if err != nil {
-			continue
+		routes = append(routes, route{filter: newFilter(&dst.Filter), dsts: cache})
+	}
+	running.wg.Add(1)
+	go func() {
+		defer running.wg.Done()
+		convertEvents(receiver.Receive(), routes, flow)
+	}()
+	return running, nil
+}
+
+// Close listener. Queued events are still uploaded, spooled ones are kept for next run.
+func (f *runningFlow) stop() {
+	f.receiver.Close()
+}
+
+func (f *runningFlow) wait() {
+	f.wg.Wait()
+}
+
+// Events passing filter are sent to route destinations.
+type route struct {
+	filter *messageFilter
+	dsts   *destinationCache
+}
+
+// Return destinations of first route which accepts message.
+func selectRoute(routes []route, msg syslogMessage) (*destinationCache, bool) {
+	for _, r := range routes {
+		if r.filter.match(msg) {
+			return r.dsts, true
+		}
+	}
+	return nil, false
+}
+
+// Parse, filter incoming messages and send them to destination of first matching route.
+func convertEvents(in <-chan receivedMessage, routes []route, flow *FlowCfg) {
+	defer func() {
+		for _, r := range routes {
+			r.dsts.close()
+		}
+	}()
+	parsefn := newParser(flow)
+	lines := newMultiline(flow)
+	filter := newFilter(&flow.Filter)
+	tpl, _ := template.New("").Parse(flow.CloudwatchFormat)
+	buf := bytes.NewBuffer([]byte{})
+	var seq uint64
+	send := func(parsed syslogMessage) {
+		if !filter.match(parsed) {
+			return
 		}
-		// Timestamp must be in milliseconds
-		event := logEvent{
-			msg:       buf.String(),
-			timestamp: parsed.timestamp.Unix() * 1000,
+		dsts, ok := selectRoute(routes, parsed)
+		if !ok {
+			return
 		}
-		err = event.validate()
+		if err := parsed.render(tpl, buf); err != nil {
+			return
+		}
+		msgs, err := fitMessage(buf.String(), flow)
 		if err != nil {
-			continue
+			log.Debugf("could not send message: %s", err)
+			return
+		}
+		for _, msg := range msgs {
+			seq++
+			dsts.send(parsed, logEvent{
+				msg:       msg,
+				timestamp: toMillis(parsed.timestamp),
+				seq:       seq,
+			})
+		}
+	}
+	var expired <-chan time.Time
+	if lines != nil {
+		ticker := time.NewTicker(lines.timeout / 2)
+		defer ticker.Stop()
+		expired = ticker.C
+	}
+	idle := time.NewTicker(flow.IdleTimeout / 2)
+	defer idle.Stop()
+	for {
+		select {
+		case received, opened := <-in:
+			if !opened {
+				if lines != nil {
+					sendAll(send, lines.flush())
+				}
+				return
+			}
+			parsed, err := parsefn(received.msg)
+			if err != nil {
+				log.Debugf("could not parse message: %s", err)
+				continue
+			}
+			parsed.setOrigin(received)
+			parsed.clampTimestamp(received.time, flow.MaxClockSkew)
+			if lines == nil {
+				send(parsed)
+				continue
+			}
+			sendAll(send, lines.add(parsed, received.time))
+		case now := <-expired:
+			sendAll(send, lines.expire(now))
+		case now := <-idle.C:
+			for _, r := range routes {
+				r.dsts.evict(now)
+			}
 		}
-		out <- event
 	}
 }
 
-// Buffer received events and send them to cloudwatch.
-func recToDst(in <-chan logEvent, cfg *FlowCfg) {
-	defer wg.Done()
-	stream_vars := getStreamVars()
-	stream_name := stream_vars.render(cfg.Stream)
-	dst := newDestination(stream_name, cfg.Group)
+func sendAll(send func(syslogMessage), messages []syslogMessage) {
+	for _, msg := range messages {
+		send(msg)
+	}
+}
+
+/*
+Buffer received events and send them to cloudwatch.
+After input is closed, memory queues are drained while
+durable queues keep remaining events for next run.
+*/
+func recToDst(in <-chan logEvent, cfg *FlowCfg, queue batchQueue) {
+	dst := newDestination(cfg.Stream, cfg.Group, cfg)
+	defer closeQueue(dst, queue)
 	ticker := newDelayTicker(cfg.UploadDelay, dst)
 	defer ticker.Stop()
-	queue := &eventQueue{max_size: cfg.QueueSize}
 	var uploadDone chan batchFunc
 	var batch eventsList
+	var reported queueStats
+	input := in
 	for {
 		select {
-		case event, opened := <-in:
+		case event, opened := <-input:
 			if !opened {
 				in = nil
 				break
@@ -153,16 +368,54 @@ func recToDst(in <-chan logEvent, cfg *FlowCfg) {
 			uploadDone = nil
 		case <-ticker.C:
 			log.Debugf("%s tick", dst)
-			if !queue.empty() && uploadDone == nil {
+			queue.sync()
+			if ready := dst.release(time.Now()); len(ready) > 0 {
+				queue.putBack(ready...)
+			}
+			if !queue.empty() && uploadDone == nil && dst.retry.ready(time.Now()) {
 				uploadDone, batch = upload(dst, queue)
 			}
+			reported = reportDropped(dst, queue, reported)
 		}
-		if in == nil && queue.empty() {
+		// Stop receiving while queue is full, so that senders are blocked.
+		input = in
+		if cfg.OverflowPolicy == overflowBlock && queue.full() {
+			input = nil
+		}
+		if in == nil && uploadDone == nil && (queue.durable() || queue.empty()) {
 			break
 		}
 	}
 }
 
+// Close queue, held events are put back to spool so that they survive restart.
+func closeQueue(dst *destination, queue batchQueue) {
+	if len(dst.tooNew) > 0 {
+		if queue.durable() {
+			queue.putBack(dst.tooNew...)
+		} else {
+			log.Warnf("%s dropping %d events too far in the future for cloudwatch", dst, len(dst.tooNew))
+		}
+		dst.tooNew, dst.heldBytes = nil, 0
+	}
+	queue.close()
+}
+
+// Log number of events dropped or changed by queue since last report.
+func reportDropped(dst *destination, queue batchQueue, reported queueStats) queueStats {
+	stats := queue.stats()
+	if stats.overflow > reported.overflow {
+		log.Warnf("%s queue full, dropped %d events", dst, stats.overflow-reported.overflow)
+	}
+	if stats.tooOld > reported.tooOld {
+		log.Warnf("%s %d events too old for cloudwatch", dst, stats.tooOld-reported.tooOld)
+	}
+	if stats.tooNew > reported.tooNew {
+		log.Warnf("%s %d events too far in the future for cloudwatch", dst, stats.tooNew-reported.tooNew)
+	}
+	return stats
+}
+
 func newDelayTicker(delay upload_delay, dst *destination) *time.Ticker {
 	d := time.Duration(delay) * time.Millisecond
 	log.Debugf("%s timer set to %s", dst, d)
@@ -174,19 +427,26 @@ func newDelayTicker(delay upload_delay, dst *destination) *time.Ticker {
 	otherwise DataAlreadyAcceptedException is returned.
 	Only one upload can proceed / tick / stream.
 */
-func upload(dst *destination, queue *eventQueue) (out chan batchFunc, batch eventsList) {
+func upload(dst *destination, queue batchQueue) (out chan batchFunc, batch eventsList) {
 	batch = queue.getBatch()
+	// All events could be outside of cloudwatch time window.
+	if len(batch) == 0 {
+		return
+	}
 	out = make(chan batchFunc)
 	log.Debugf("%s sending %d messages", dst, len(batch))
 	go func() {
-		result := dst.upload(batch)
-		out <- handleResult(dst, result)
+		rejected, result := dst.upload(batch)
+		out <- handleResult(dst, result, rejected)
 	}()
 	return out, batch
 }
 
-func handleResult(dst *destination, result error) batchFunc {
+func handleResult(dst *destination, result error, rejected rejectedEvents) batchFunc {
 	switch err := result.(type) {
+	case nil:
+		dst.retry.reset()
+		return handleRejected(dst, rejected)
 	case awserr.Error:
 		switch err.Code() {
 		case "InvalidSequenceTokenException":
@@ -198,39 +458,49 @@ func handleResult(dst *destination, result error) batchFunc {
 			dst.create()
 			dst.token = nil
 			return addBack
-		default:
-			log.Errorf("upload to %s failed %s %s", dst, err.Code(), err.Message())
 		}
-	case nil:
-	default:
-		log.Errorf("upload to %s failed %s ", dst, result)
 	}
-	return discard
+	if !isRetryable(result) {
+		log.Errorf("upload to %s failed %s", dst, result)
+		dst.retry.reset()
+		return discard
+	}
+	since := dst.retry.since
+	if !dst.retry.failed(time.Now()) {
+		return func(batch eventsList, queue batchQueue) {
+			log.Errorf("upload to %s failing since %s, dropping %d events: %s", dst, since, len(batch), result)
+			discard(batch, queue)
+		}
+	}
+	log.Warnf("upload to %s failed, retry %d after %s: %s", dst, dst.retry.attempts, dst.retry.next.Sub(time.Now()), result)
+	return addBack
+}
+
+// Hold back rejected events which should be uploaded again once they are accepted.
+func handleRejected(dst *destination, rejected rejectedEvents) batchFunc {
+	return func(batch eventsList, queue batchQueue) {
+		retry := dst.countRejected(batch, rejected)
+		queue.done(batch[:len(batch)-len(retry)])
+		queue.done(dst.hold(retry))
+	}
 }
 
-type batchFunc func(batch eventsList, queue *eventQueue)
+type batchFunc func(batch eventsList, queue batchQueue)
 
-func addBack(batch eventsList, queue *eventQueue) {
-	queue.add(batch...)
+func addBack(batch eventsList, queue batchQueue) {
+	queue.putBack(batch...)
 }
 
-func discard(batch eventsList, queue *eventQueue) {}
+func discard(batch eventsList, queue batchQueue) {
+	queue.done(batch)
+}
 
+// Agent host variables available in group and stream templates.
 type streamVars struct {
 	InstanceID string
 	Hostname   string
 }
 
-func (v streamVars) render(format string) string {
-	buf := bytes.NewBuffer([]byte{})
-	tpl, err := template.New("").Parse(format)
-	if err != nil {
-		log.Fatalf("failed to render stream name: %v", err)
-	}
-	tpl.Execute(buf, v)
-	return buf.String()
-}
-
 func getStreamVars() (variables streamVars) {
 	hostname, err := os.Hostname()
 	variables.Hostname = "UNKNOWN"
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_diffFlows(t *testing.T) {
+	running := map[string]*runningFlow{
+		"same":    {cfg: &FlowCfg{Name: "same", Group: "group"}},
+		"changed": {cfg: &FlowCfg{Name: "changed", Group: "group"}},
+		"removed": {cfg: &FlowCfg{Name: "removed", Group: "group"}},
+	}
+	flows := []*FlowCfg{
+		{Name: "same", Group: "group"},
+		{Name: "changed", Group: "other"},
+		{Name: "added", Group: "group"},
+	}
+	stop, start := diffFlows(running, flows)
+	var stopped []string
+	for _, flow := range stop {
+		stopped = append(stopped, flow.cfg.Name)
+	}
+	assert.Equal(t, 2, len(stopped))
+	assert.Contains(t, stopped, "changed")
+	assert.Contains(t, stopped, "removed")
+	assert.Equal(t, []*FlowCfg{flows[1], flows[2]}, start)
+}
+
+// Assert that invalid config is rejected instead of exiting.
+func Test_loadFlows_invalid(t *testing.T) {
+	file, remove := tempConfig(t, "config.ini", "[app]\ngroup = app\nstream = app\nqueue_size = 0\n")
+	defer remove()
+	_, err := loadFlows(file)
+	assert.NotNil(t, err)
+	_, err = loadFlows(file + ".missing")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"regexp"
+	"time"
+)
+
+const (
+	defaultMultilineTimeout = time.Second
+	multilineSeparator      = "\n"
+)
+
+/*
+Joins consecutive messages from the same host and tag into one event.
+With start pattern, message not matching it continues previous one.
+With continue pattern, message matching it continues previous one.
+Event is flushed when a new one starts, when it would grow over maxSize
+or when no message was appended to it for timeout.
+*/
+type multiline struct {
+	start   *regexp.Regexp
+	cont    *regexp.Regexp
+	timeout time.Duration
+	maxSize int
+	pending map[string]*pendingEvent
+	// Keys of pending events in order they were started.
+	order []string
+}
+
+type pendingEvent struct {
+	msg syslogMessage
+	// When message was last appended.
+	updated time.Time
+}
+
+// Return nil when no pattern is configured.
+func newMultiline(flow *FlowCfg) *multiline {
+	if flow.MultilineStart == "" && flow.MultilineContinue == "" {
+		return nil
+	}
+	maxSize, _ := parseByteSize(flow.MultilineMaxSize)
+	if maxSize == 0 || maxSize > maxMessageSize {
+		maxSize = maxMessageSize
+	}
+	m := &multiline{
+		timeout: flow.MultilineTimeout,
+		maxSize: int(maxSize),
+		pending: make(map[string]*pendingEvent),
+	}
+	if flow.MultilineStart != "" {
+		m.start = regexp.MustCompile(flow.MultilineStart)
+	}
+	if flow.MultilineContinue != "" {
+		m.cont = regexp.MustCompile(flow.MultilineContinue)
+	}
+	return m
+}
+
+// Add message and return events which are complete.
+func (m *multiline) add(msg syslogMessage, now time.Time) (complete []syslogMessage) {
+	key := msg.Hostname + "\x00" + msg.tag()
+	if p, ok := m.pending[key]; ok {
+		if m.continues(msg) && len(p.msg.Message)+len(multilineSeparator)+len(msg.Message) <= m.maxSize {
+			p.msg.Message += multilineSeparator + msg.Message
+			p.updated = now
+			return
+		}
+		complete = append(complete, m.remove(key))
+	}
+	m.pending[key] = &pendingEvent{msg: msg, updated: now}
+	m.order = append(m.order, key)
+	return
+}
+
+func (m *multiline) continues(msg syslogMessage) bool {
+	if m.start != nil {
+		return !m.start.MatchString(msg.Message)
+	}
+	return m.cont.MatchString(msg.Message)
+}
+
+// Return events which were not appended to for timeout, in order they were started.
+func (m *multiline) expire(now time.Time) (complete []syslogMessage) {
+	for _, key := range append([]string{}, m.order...) {
+		if now.Sub(m.pending[key].updated) >= m.timeout {
+			complete = append(complete, m.remove(key))
+		}
+	}
+	return
+}
+
+// Return all pending events.
+func (m *multiline) flush() (complete []syslogMessage) {
+	for len(m.order) > 0 {
+		complete = append(complete, m.remove(m.order[0]))
+	}
+	return
+}
+
+func (m *multiline) remove(key string) syslogMessage {
+	msg := m.pending[key].msg
+	delete(m.pending, key)
+	for i, orderKey := range m.order {
+		if orderKey == key {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	return msg
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func addLines(m *multiline, now time.Time, lines ...string) (complete []string) {
+	for _, line := range lines {
+		for _, msg := range m.add(syslogMessage{Hostname: "host", Syslogtag: "app:", Message: line}, now) {
+			complete = append(complete, msg.Message)
+		}
+	}
+	return
+}
+
+func messageTexts(msgs []syslogMessage) (result []string) {
+	for _, msg := range msgs {
+		result = append(result, msg.Message)
+	}
+	return
+}
+
+func Test_newMultiline_disabled(t *testing.T) {
+	assert.Nil(t, newMultiline(&FlowCfg{}))
+}
+
+func Test_multiline_start(t *testing.T) {
+	m := newMultiline(&FlowCfg{MultilineStart: `^\S`, MultilineTimeout: time.Second})
+	complete := addLines(m, time.Now(), "Exception", "  at a", "  at b", "Next")
+	assert.Equal(t, []string{"Exception\n  at a\n  at b"}, complete)
+	assert.Equal(t, []string{"Next"}, messageTexts(m.flush()))
+}
+
+func Test_multiline_continue(t *testing.T) {
+	m := newMultiline(&FlowCfg{MultilineContinue: `^\s`, MultilineTimeout: time.Second})
+	complete := addLines(m, time.Now(), "Traceback", "  File", "Error", "Next")
+	assert.Equal(t, []string{"Traceback\n  File", "Error"}, complete)
+}
+
+// Assert that messages from different hosts are not joined.
+func Test_multiline_different_host(t *testing.T) {
+	m := newMultiline(&FlowCfg{MultilineStart: `^\S`, MultilineTimeout: time.Second})
+	now := time.Now()
+	m.add(syslogMessage{Hostname: "first", Message: "Exception"}, now)
+	m.add(syslogMessage{Hostname: "second", Message: "  at a"}, now)
+	assert.Equal(t, []string{"Exception", "  at a"}, messageTexts(m.flush()))
+}
+
+// Assert that RFC5424 messages of different apps on the same host are not joined.
+func Test_multiline_different_app(t *testing.T) {
+	m := newMultiline(&FlowCfg{MultilineStart: `^\S`, MultilineTimeout: time.Second})
+	now := time.Now()
+	m.add(syslogMessage{Hostname: "host", AppName: "appA", Format: formatRFC5424, Message: "start A"}, now)
+	m.add(syslogMessage{Hostname: "host", AppName: "appB", Format: formatRFC5424, Message: "  continuation from B"}, now)
+	assert.Equal(t, []string{"start A", "  continuation from B"}, messageTexts(m.flush()))
+}
+
+func Test_multiline_max_size(t *testing.T) {
+	m := newMultiline(&FlowCfg{MultilineStart: `^\S`, MultilineTimeout: time.Second, MultilineMaxSize: "10"})
+	complete := addLines(m, time.Now(), "Exception", " at a")
+	assert.Equal(t, []string{"Exception"}, complete)
+}
+
+func Test_multiline_expire(t *testing.T) {
+	m := newMultiline(&FlowCfg{MultilineStart: `^\S`, MultilineTimeout: time.Second})
+	now := time.Now()
+	addLines(m, now, "Exception")
+	assert.Nil(t, m.expire(now.Add(time.Millisecond)))
+	assert.Equal(t, []string{"Exception"}, messageTexts(m.expire(now.Add(time.Second))))
+	assert.Empty(t, m.pending)
+	assert.Empty(t, m.order)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	oversizeDropOption     = "drop"
+	oversizeTruncateOption = "truncate"
+	oversizeSplitOption    = "split"
+
+	defaultTruncateMarker = "…[truncated %d bytes]"
+	// Appended to each part of split message. Part number, number of parts and correlation id.
+	splitSuffix = " [part %d/%d %s]"
+	// Maximum message size which fits in a single cloudwatch event.
+	maxMessageSize        = maxEventSize - eventSizeOverhead
+	maxTruncateMarkerSize = 1024
+)
+
+var validOversizeOptions = []string{
+	oversizeDropOption,
+	oversizeTruncateOption,
+	oversizeSplitOption,
+}
+
+// Return message as one or more messages which fit in cloudwatch event.
+func fitMessage(msg string, flow *FlowCfg) ([]string, error) {
+	if len(msg) <= maxMessageSize {
+		return []string{msg}, nil
+	}
+	switch flow.OversizedMessage {
+	case oversizeTruncateOption:
+		return []string{truncateMessage(msg, maxMessageSize, flow.TruncateMarker)}, nil
+	case oversizeSplitOption:
+		return splitMessage(msg, maxMessageSize, fmt.Sprintf("%08x", rand.Uint32())), nil
+	}
+	return nil, errMessageTooBig
+}
+
+/*
+Keep beginning of message so that together with marker it is not longer than
+limit. %d in marker is replaced with number of removed bytes.
+*/
+func truncateMessage(msg string, limit int, marker string) string {
+	if len(msg) <= limit {
+		return msg
+	}
+	// Removed bytes never have more digits than whole message.
+	keep := utf8Prefix(msg, limit-len(formatMarker(marker, len(msg))))
+	// Marker for actual number of removed bytes may be shorter.
+	keep = utf8Prefix(msg, limit-len(formatMarker(marker, len(msg)-keep)))
+	return msg[:keep] + formatMarker(marker, len(msg)-keep)
+}
+
+func formatMarker(marker string, removed int) string {
+	return strings.Replace(marker, "%d", strconv.Itoa(removed), -1)
+}
+
+// Split message into parts not longer than limit, each ending with suffix sharing id.
+func splitMessage(msg string, limit int, id string) (parts []string) {
+	// Part numbers never have more digits than whole message length.
+	size := limit - len(fmt.Sprintf(splitSuffix, len(msg), len(msg), id))
+	for len(msg) > 0 {
+		end := utf8Prefix(msg, size)
+		parts = append(parts, msg[:end])
+		msg = msg[end:]
+	}
+	for i := range parts {
+		parts[i] += fmt.Sprintf(splitSuffix, i+1, len(parts), id)
+	}
+	return
+}
+
+// Return length of longest prefix not longer than size which ends on rune boundary.
+func utf8Prefix(msg string, size int) int {
+	if size >= len(msg) {
+		return len(msg)
+	}
+	if size <= 0 {
+		return 0
+	}
+	for size > 0 && !utf8.RuneStart(msg[size]) {
+		size--
+	}
+	return size
+}
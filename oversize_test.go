@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_truncateMessage(t *testing.T) {
+	assert.Equal(t, "abc[-7]", truncateMessage("abcdefghij", 7, "[-%d]"))
+}
+
+func Test_truncateMessage_short(t *testing.T) {
+	assert.Equal(t, "abc", truncateMessage("abc", 7, "[-%d]"))
+}
+
+// Assert that multi byte characters are not cut in half.
+func Test_truncateMessage_utf8(t *testing.T) {
+	truncated := truncateMessage("ąęśćż", 5, "…")
+	assert.Equal(t, "ą…", truncated)
+	assert.True(t, utf8.ValidString(truncated))
+}
+
+func Test_splitMessage(t *testing.T) {
+	msg := strings.Repeat("ą", 40)
+	parts := splitMessage(msg, 50, "id")
+	var joined string
+	for i, part := range parts {
+		assert.True(t, len(part) <= 50)
+		assert.True(t, utf8.ValidString(part))
+		suffix := fmt.Sprintf(splitSuffix, i+1, len(parts), "id")
+		assert.True(t, strings.HasSuffix(part, suffix), part)
+		joined += strings.TrimSuffix(part, suffix)
+	}
+	assert.Equal(t, msg, joined)
+}
+
+func Test_fitMessage_drop(t *testing.T) {
+	_, err := fitMessage(RandomString(maxMessageSize+1), &FlowCfg{OversizedMessage: oversizeDropOption})
+	assert.Equal(t, errMessageTooBig, err)
+}
+
+func Test_fitMessage_truncate(t *testing.T) {
+	msgs, err := fitMessage(RandomString(maxEventSize), &FlowCfg{OversizedMessage: oversizeTruncateOption, TruncateMarker: defaultTruncateMarker})
+	assert.Nil(t, err)
+	assert.Equal(t, maxMessageSize, len(msgs[0]))
+	assert.True(t, strings.HasSuffix(msgs[0], "…[truncated 49 bytes]"))
+}
+
+func Test_fitMessage_fits(t *testing.T) {
+	msgs, err := fitMessage("message", &FlowCfg{OversizedMessage: oversizeDropOption})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"message"}, msgs)
+}
@@ -1,63 +1,436 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 type syslogParser func(msg string) (syslogMessage, error)
 
+const (
+	formatRFC3164 = "RFC3164"
+	formatRFC5424 = "RFC5424"
+	formatRaw     = "raw"
+	formatJSON    = "json"
+	formatAuto    = "auto"
+
+	// Special json_time_layout values
+	unixTimeLayout   = "unix"
+	unixMsTimeLayout = "unix_ms"
+)
+
 var parserFunctions = map[string]syslogParser{
-	"RFC3164": parseRFC3164,
+	formatRFC3164: parseRFC3164,
+	formatRFC5424: parseRFC5424,
+	formatRaw:     parseRaw,
+	formatJSON:    parseJSON,
+	formatAuto:    parseAuto,
 }
 
-// https://tools.ietf.org/html/rfc3164
+// Parsers tried in order by auto format.
+var autoParsers = []syslogParser{
+	parseRFC5424,
+	parseRFC3164,
+	parseRaw,
+}
+
+// RFC5424 NILVALUE
+const nilValue = "-"
+
+/*
+https://tools.ietf.org/html/rfc3164
+HOSTNAME and TAG are optional since local senders (e.g. logger) often omit them.
+Fields may be separated by more than one space.
+*/
 func parseRFC3164(str string) (parsed syslogMessage, err error) {
-	str = strings.Replace(str, "<", "", 1)
-	str = strings.Replace(str, ">", " ", 1)
-	str = strings.Replace(str, "  ", " ", 1)
-	strs := strings.SplitN(str, " ", 7)
-	if len(strs) != 7 {
+	parsed.Format = formatRFC3164
+	priority, rest, err := parsePriority(str)
+	if err != nil {
+		return
+	}
+	parsed.Facility, parsed.Severity = priority.decode()
+
+	parsed.timestamp, parsed.zoneless, rest, err = parseRFC3164Header(rest, time.Now())
+	if err != nil {
+		return
+	}
+
+	token, next := nextToken(rest)
+	if !isTag(token) {
+		parsed.Hostname, rest = token, next
+		token, next = nextToken(rest)
+	}
+	if isTag(token) {
+		parsed.Syslogtag, rest = token, next
+		parsed.Program, parsed.PID = splitTag(token)
+	}
+
+	parsed.Message = strings.TrimSpace(rest)
+	if parsed.Message == "" {
+		err = errEmptyMessage
+	}
+	return
+}
+
+/*
+Parse timestamp which is either in "Mmm dd hh:mm:ss" or RFC3339 format.
+The former carries no time zone so it is parsed as UTC and reported as zoneless.
+*/
+func parseRFC3164Header(str string, now time.Time) (ts time.Time, zoneless bool, rest string, err error) {
+	token, rest := nextToken(str)
+	if ts, err = time.Parse(time.RFC3339Nano, token); err == nil {
+		return
+	}
+	var day, clock string
+	day, rest = nextToken(rest)
+	clock, rest = nextToken(rest)
+	ts, err = parseRFC3164Timestamp(strings.Join([]string{token, day, clock}, " "), now)
+	if err != nil {
 		err = errUnknownMessageFormat
+	}
+	return ts, true, rest, err
+}
+
+// https://tools.ietf.org/html/rfc3164#section-4.1.2
+// Year is not sent so the one which places timestamp nearest to now is picked.
+func parseRFC3164Timestamp(timestamp string, now time.Time) (ts time.Time, err error) {
+	ts, err = time.Parse("Jan 2 15:04:05", timestamp)
+	if err != nil {
 		return
 	}
+	best := time.Date(now.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(),
+		ts.Second(), ts.Nanosecond(), ts.Location())
+	for _, year := range []int{now.Year() - 1, now.Year() + 1} {
+		candidate := time.Date(year, ts.Month(), ts.Day(), ts.Hour(), ts.Minute(),
+			ts.Second(), ts.Nanosecond(), ts.Location())
+		if absDuration(candidate.Sub(now)) < absDuration(best.Sub(now)) {
+			best = candidate
+		}
+	}
+	return best, nil
+}
+
+// Return first space delimited token and the rest of string.
+func nextToken(str string) (token, rest string) {
+	str = strings.TrimLeft(str, " ")
+	if end := strings.IndexByte(str, ' '); end >= 0 {
+		return str[:end], str[end:]
+	}
+	return str, ""
+}
 
-	priority, err := strconv.Atoi(strs[0])
+// Tag is either "program:", "program[pid]:" or "program[pid]".
+func isTag(token string) bool {
+	return strings.HasSuffix(token, ":") && len(token) > 1 ||
+		strings.HasSuffix(token, "]") && strings.Index(token, "[") > 0
+}
+
+func splitTag(tag string) (program, pid string) {
+	tag = strings.TrimSuffix(tag, ":")
+	open := strings.IndexByte(tag, '[')
+	if open < 1 || !strings.HasSuffix(tag, "]") {
+		return tag, ""
+	}
+	return tag[:open], tag[open+1 : len(tag)-1]
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// https://tools.ietf.org/html/rfc5424#section-6
+func parseRFC5424(str string) (parsed syslogMessage, err error) {
+	parsed.Format = formatRFC5424
+	priority, rest, err := parsePriority(str)
 	if err != nil {
 		return
 	}
-	fac, sev := SyslogPriority(priority).decode()
-	parsed.Facility = fac
-	parsed.Severity = sev
+	parsed.Facility, parsed.Severity = priority.decode()
 
-	date := strings.Join(strs[1:4], " ")
-	timestamp, err := parseRFC3164Timestamp(date)
+	// VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+	strs := strings.SplitN(rest, " ", 7)
+	if len(strs) != 7 {
+		err = errUnknownMessageFormat
+		return
+	}
+	parsed.Version, err = strconv.Atoi(strs[0])
+	if err != nil || parsed.Version < 1 {
+		err = errUnknownMessageFormat
+		return
+	}
+	parsed.timestamp, err = parseRFC5424Timestamp(strs[1])
 	if err != nil {
 		return
 	}
-	parsed.timestamp = timestamp
+	parsed.Hostname = nilToEmpty(strs[2])
+	parsed.AppName = nilToEmpty(strs[3])
+	parsed.ProcID = nilToEmpty(strs[4])
+	parsed.MsgID = nilToEmpty(strs[5])
 
-	parsed.Message = strings.TrimSpace(strs[6])
+	parsed.StructuredData, rest, err = parseStructuredData(strs[6])
+	if err != nil {
+		return
+	}
+	parsed.Message = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff"))
 	if parsed.Message == "" {
 		err = errEmptyMessage
+	}
+	return
+}
+
+// Parse <PRI> header and return remaining string.
+func parsePriority(str string) (priority SyslogPriority, rest string, err error) {
+	end := strings.IndexByte(str, '>')
+	if !strings.HasPrefix(str, "<") || end < 2 || end > 4 {
+		err = errUnknownMessageFormat
+		return
+	}
+	value, err := strconv.Atoi(str[1:end])
+	if err != nil || value > 191 {
+		err = errUnknownMessageFormat
 		return
 	}
+	return SyslogPriority(value), str[end+1:], nil
+}
 
-	parsed.Syslogtag = strs[5]
-	parsed.Hostname = strs[4]
+// https://tools.ietf.org/html/rfc5424#section-6.2.3
+// Missing timestamp is left zero and later replaced with receive time.
+func parseRFC5424Timestamp(timestamp string) (time.Time, error) {
+	if timestamp == nilValue {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, timestamp)
+}
 
+/*
+Parse STRUCTURED-DATA part and return message which follows it.
+https://tools.ietf.org/html/rfc5424#section-6.3
+*/
+func parseStructuredData(str string) (data map[string]map[string]string, rest string, err error) {
+	data = make(map[string]map[string]string)
+	if strings.HasPrefix(str, nilValue) {
+		return data, str[len(nilValue):], nil
+	}
+	rest = str
+	for strings.HasPrefix(rest, "[") {
+		var id string
+		var params map[string]string
+		id, params, rest, err = parseSDElement(rest[1:])
+		if err != nil {
+			return
+		}
+		data[id] = params
+	}
+	if len(data) == 0 {
+		err = errUnknownMessageFormat
+	}
 	return
 }
 
-// https://tools.ietf.org/html/rfc3164#section-4.1.2
-func parseRFC3164Timestamp(timestamp string) (ts time.Time, err error) {
-	ts, err = time.Parse(time.Stamp, timestamp)
-	if err != nil {
+// Parse single SD-ELEMENT without its opening bracket.
+func parseSDElement(str string) (id string, params map[string]string, rest string, err error) {
+	params = make(map[string]string)
+	end := strings.IndexAny(str, " ]")
+	if end < 1 {
+		err = errUnknownMessageFormat
 		return
 	}
-	now := time.Now()
-	ts = time.Date(now.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(),
-		ts.Second(), ts.Nanosecond(), ts.Location())
+	id, rest = str[:end], str[end:]
+	for strings.HasPrefix(rest, " ") {
+		var name, value string
+		name, value, rest, err = parseSDParam(rest[1:])
+		if err != nil {
+			return
+		}
+		params[name] = value
+	}
+	if !strings.HasPrefix(rest, "]") {
+		err = errUnknownMessageFormat
+		return
+	}
+	return id, params, rest[1:], nil
+}
+
+// Parse PARAM-NAME="PARAM-VALUE". Escaped '"', '\\' and ']' are unescaped.
+func parseSDParam(str string) (name, value, rest string, err error) {
+	eq := strings.Index(str, "=\"")
+	if eq < 1 {
+		err = errUnknownMessageFormat
+		return
+	}
+	name = str[:eq]
+	buf := make([]byte, 0, len(str)-eq)
+	for i := eq + 2; i < len(str); i++ {
+		switch str[i] {
+		case '\\':
+			if i+1 < len(str) && strings.IndexByte("\"\\]", str[i+1]) >= 0 {
+				i++
+			}
+			buf = append(buf, str[i])
+		case '"':
+			return name, string(buf), str[i+1:], nil
+		default:
+			buf = append(buf, str[i])
+		}
+	}
+	err = errUnknownMessageFormat
+	return
+}
+
+func nilToEmpty(value string) string {
+	if value == nilValue {
+		return ""
+	}
+	return value
+}
+
+/*
+Try every parser from autoParsers and return first successful result.
+Messages recognized as empty are not passed to following parsers.
+*/
+func parseAuto(str string) (parsed syslogMessage, err error) {
+	for _, parsefn := range autoParsers {
+		parsed, err = parsefn(str)
+		if err == nil || err == errEmptyMessage {
+			return
+		}
+	}
+	return
+}
+
+/*
+Treat whole string as message body. Timestamp and hostname are taken from receiver.
+Priority is user.notice as for messages without PRI, see RFC 3164 section 4.3.3.
+*/
+func parseRaw(str string) (parsed syslogMessage, err error) {
+	parsed.Format = formatRaw
+	parsed.Facility, parsed.Severity = logUser, logNotice
+	parsed.Message = strings.TrimSpace(str)
+	if parsed.Message == "" {
+		err = errEmptyMessage
+	}
+	return
+}
+
+// Whole string must be a JSON object. Message is left as received.
+func parseJSON(str string) (parsed syslogMessage, err error) {
+	parsed.Format = formatJSON
+	parsed.Message = strings.TrimSpace(str)
+	if parsed.Message == "" {
+		err = errEmptyMessage
+		return
+	}
+	parsed.Fields, err = decodeJSONObject(parsed.Message)
 	return
 }
+
+// Numbers are kept as json.Number so that they are rendered exactly as received.
+func decodeJSONObject(str string) (fields map[string]interface{}, err error) {
+	decoder := json.NewDecoder(strings.NewReader(str))
+	decoder.UseNumber()
+	if err = decoder.Decode(&fields); err != nil || fields == nil {
+		return nil, errUnknownMessageFormat
+	}
+	return
+}
+
+/*
+Return parser for flow format. Timestamps without time zone are interpreted
+in flow timezone. When json_message is enabled, message body of syslog messages
+is additionally decoded into Fields. Messages which body is not a JSON object
+are passed on without Fields.
+*/
+func newParser(flow *FlowCfg) syslogParser {
+	parsefn := parserFunctions[flow.SyslogFormat]
+	loc := loadTimezone(flow.Timezone)
+	withJSON := flow.SyslogFormat == formatJSON || flow.JSONMessage
+	return func(str string) (parsed syslogMessage, err error) {
+		parsed, err = parsefn(str)
+		if err != nil {
+			return
+		}
+		if parsed.zoneless {
+			parsed.timestamp = inLocation(parsed.timestamp, loc)
+		}
+		if !withJSON {
+			return
+		}
+		if parsed.Fields == nil {
+			parsed.Fields, _ = decodeJSONObject(parsed.Message)
+		}
+		if flow.JSONTimeKey != "" {
+			setJSONTimestamp(&parsed, flow.JSONTimeKey, flow.JSONTimeLayout, loc)
+		}
+		return
+	}
+}
+
+// Empty name means UTC. Names are validated with configuration.
+func loadTimezone(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Return time with the same wall clock in given location.
+func inLocation(ts time.Time, loc *time.Location) time.Time {
+	return time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(),
+		ts.Second(), ts.Nanosecond(), loc)
+}
+
+/*
+Replace message timestamp with value of JSON field. Missing or invalid values are ignored.
+Layouts without time zone are interpreted in loc.
+*/
+func setJSONTimestamp(parsed *syslogMessage, key, layout string, loc *time.Location) {
+	value, ok := lookupField(parsed.Fields, key)
+	if !ok {
+		return
+	}
+	ts, err := parseJSONTime(value, layout, loc)
+	if err != nil {
+		log.Debugf("could not parse %s field: %s", key, err)
+		return
+	}
+	parsed.timestamp = ts
+}
+
+// Return value under dot separated path e.g. request.id
+func lookupField(fields map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = fields
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func parseJSONTime(value interface{}, layout string, loc *time.Location) (time.Time, error) {
+	switch layout {
+	case unixTimeLayout, unixMsTimeLayout:
+		number, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if layout == unixTimeLayout {
+			number *= 1000
+		}
+		return time.Unix(0, int64(number)*int64(time.Millisecond)), nil
+	}
+	return time.ParseInLocation(layout, fmt.Sprint(value), loc)
+}
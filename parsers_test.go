@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/stretchr/testify/assert"
@@ -19,6 +21,89 @@ func Test_Parse_RFC3164_Severity(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+// Real world samples. Timestamps are checked separately.
+func Test_parseRFC3164_corpus(t *testing.T) {
+	for _, tc := range []struct {
+		msg      string
+		expected syslogMessage
+	}{
+		{
+			// logger sends messages without HOSTNAME to local socket
+			msg:      "<13>Jul 23 14:48:16 user: hello world",
+			expected: syslogMessage{Facility: logUser, Severity: logNotice, Syslogtag: "user:", Program: "user", Message: "hello world"},
+		},
+		{
+			msg:      "<38>Feb  5 17:32:18 10.0.0.99 sshd[4215]: Accepted publickey for root",
+			expected: syslogMessage{Facility: logAuth, Severity: logInfo, Hostname: "10.0.0.99", Syslogtag: "sshd[4215]:", Program: "sshd", PID: "4215", Message: "Accepted publickey for root"},
+		},
+		{
+			msg:      "<78>Feb 5 17:32:18 host CRON[1234] (root) CMD (run-parts /etc/cron.hourly)",
+			expected: syslogMessage{Facility: logClock, Severity: logInfo, Hostname: "host", Syslogtag: "CRON[1234]", Program: "CRON", PID: "1234", Message: "(root) CMD (run-parts /etc/cron.hourly)"},
+		},
+		{
+			// missing TAG
+			msg:      "<30>Oct 11 22:14:15 mymachine   message  without tag",
+			expected: syslogMessage{Facility: logDaemon, Severity: logInfo, Hostname: "mymachine", Message: "message  without tag"},
+		},
+		{
+			msg:      "<0>Oct 1 00:00:00 host kernel: Oops",
+			expected: syslogMessage{Facility: logKern, Severity: logEmerg, Hostname: "host", Syslogtag: "kernel:", Program: "kernel", Message: "Oops"},
+		},
+		{
+			// rsyslog high precision timestamp
+			msg:      "<86>2017-07-23T14:48:16.123+02:00 debian sudo: session opened",
+			expected: syslogMessage{Facility: logAuthpriv, Severity: logInfo, Hostname: "debian", Syslogtag: "sudo:", Program: "sudo", Message: "session opened"},
+		},
+	} {
+		parsed, err := parseRFC3164(tc.msg)
+		assert.Nil(t, err, tc.msg)
+		parsed.timestamp, parsed.zoneless = time.Time{}, false
+		tc.expected.Format = formatRFC3164
+		assert.Equal(t, tc.expected, parsed, tc.msg)
+	}
+}
+
+func Test_parseRFC3164_single_digit_day(t *testing.T) {
+	for _, msg := range []string{
+		"<13>Feb  5 17:32:18 host tag: msg",
+		"<13>Feb 5 17:32:18 host tag: msg",
+	} {
+		parsed, err := parseRFC3164(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, 5, parsed.timestamp.Day())
+		assert.Equal(t, 17, parsed.timestamp.Hour())
+	}
+}
+
+func Test_parseRFC3164Timestamp_year(t *testing.T) {
+	for _, tc := range []struct {
+		timestamp string
+		now       time.Time
+		year      int
+	}{
+		{"Dec 31 23:59:59", time.Date(2017, 1, 1, 0, 0, 1, 0, time.UTC), 2016},
+		{"Jan  1 00:00:01", time.Date(2016, 12, 31, 23, 59, 59, 0, time.UTC), 2017},
+		{"Jul 23 14:48:16", time.Date(2017, 7, 23, 14, 48, 16, 0, time.UTC), 2017},
+		{"Feb 29 12:00:00", time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC), 2016},
+	} {
+		ts, _, _, err := parseRFC3164Header(tc.timestamp, tc.now)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.year, ts.Year(), tc.timestamp)
+	}
+}
+
+func Test_splitTag(t *testing.T) {
+	for tag, expected := range map[string][2]string{
+		"sshd[123]:": {"sshd", "123"},
+		"sshd[123]":  {"sshd", "123"},
+		"sudo:":      {"sudo", ""},
+		"[123]:":     {"[123]", ""},
+	} {
+		program, pid := splitTag(tag)
+		assert.Equal(t, expected, [2]string{program, pid}, tag)
+	}
+}
+
 func Test_parseRFC3164_empty(t *testing.T) {
 	msg := "<86>Jul 23 14:48:16 debian sudo:     "
 	_, err := parseRFC3164(msg)
@@ -44,3 +129,219 @@ func Benchmark_parseRCF3164(b *testing.B) {
 		parseRFC3164(msg)
 	}
 }
+
+func Test_parseRFC5424(t *testing.T) {
+	msg := `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 1234 ID47 [exampleSDID@32473 iut="3" eventSource="Application"][origin@123 ip="10.0.0.1"] An application event`
+	parsed, err := parseRFC5424(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, logNotice, parsed.Severity)
+	assert.Equal(t, logLocal4, parsed.Facility)
+	assert.Equal(t, 1, parsed.Version)
+	assert.Equal(t, time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC), parsed.timestamp)
+	assert.Equal(t, "mymachine.example.com", parsed.Hostname)
+	assert.Equal(t, "evntslog", parsed.AppName)
+	assert.Equal(t, "1234", parsed.ProcID)
+	assert.Equal(t, "ID47", parsed.MsgID)
+	assert.Equal(t, map[string]map[string]string{
+		"exampleSDID@32473": {"iut": "3", "eventSource": "Application"},
+		"origin@123":        {"ip": "10.0.0.1"},
+	}, parsed.StructuredData)
+	assert.Equal(t, "An application event", parsed.Message)
+}
+
+func Test_parseRFC5424_nil_values(t *testing.T) {
+	msg := "<34>1 2003-10-11T22:14:15.003-07:00 - - - - - \ufeffsu root failed"
+	parsed, err := parseRFC5424(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "", parsed.Hostname)
+	assert.Equal(t, "", parsed.AppName)
+	assert.Empty(t, parsed.StructuredData)
+	assert.Equal(t, "su root failed", parsed.Message)
+	assert.Equal(t, int64(1065935655), parsed.timestamp.Unix())
+}
+
+func Test_parseRFC5424_escaped_param(t *testing.T) {
+	msg := `<34>1 - host app - - [id@1 a="q\"b\\s\]e" b="x"] msg`
+	parsed, err := parseRFC5424(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"a": `q"b\s]e`, "b": "x"}, parsed.StructuredData["id@1"])
+}
+
+// Assert that rendered template can access structured data.
+func Test_parseRFC5424_render(t *testing.T) {
+	msg := `<34>1 - host app - - [origin@123 ip="10.0.0.1"] msg`
+	parsed, _ := parseRFC5424(msg)
+	buf := bytes.NewBuffer([]byte{})
+	tpl, _ := template.New("").Parse(`{{.AppName}} {{index .StructuredData "origin@123" "ip"}}`)
+	assert.Nil(t, parsed.render(tpl, buf))
+	assert.Equal(t, "app 10.0.0.1", buf.String())
+}
+
+func Test_parseRFC5424_empty(t *testing.T) {
+	_, err := parseRFC5424("<34>1 - host app - - -")
+	assert.Equal(t, errEmptyMessage, err)
+}
+
+func Test_parseRFC5424_invalid(t *testing.T) {
+	for _, msg := range []string{
+		"kfjlsdkfdlsjdlfgkdlsfghsdlfgkh",
+		"<86>Jul 23 14:48:16 debian sudo: pam_unix(sudo:session): session closed for user root",
+		"<192>1 - host app - - - msg",
+		"<34>0 - host app - - - msg",
+		"<34>1 - host app - - [id@1 a=\"unterminated] msg",
+		"<34>1 - host app - - [id@1 a=\"b\" msg",
+		"<34>1 - host app - - nosd msg",
+	} {
+		_, err := parseRFC5424(msg)
+		assert.Equal(t, errUnknownMessageFormat, err, msg)
+	}
+}
+
+func Test_parseAuto_format(t *testing.T) {
+	for msg, expected := range map[string]string{
+		"<34>1 - host app - - - msg":                      formatRFC5424,
+		"<86>Jul 23 14:48:16 debian sudo: session closed": formatRFC3164,
+		"plain line without header":                       formatRaw,
+	} {
+		parsed, err := parseAuto(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, parsed.Format, msg)
+	}
+}
+
+// Assert that message recognized as empty is not passed to fallback parsers.
+func Test_parseAuto_empty(t *testing.T) {
+	_, err := parseAuto("<34>1 - host app - - -")
+	assert.Equal(t, errEmptyMessage, err)
+}
+
+func Test_parseRaw(t *testing.T) {
+	parsed, err := parseRaw("  plain line\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "plain line", parsed.Message)
+	assert.Equal(t, formatRaw, parsed.Format)
+	assert.Equal(t, logUser, parsed.Facility)
+	assert.Equal(t, logNotice, parsed.Severity)
+	assert.True(t, parsed.timestamp.IsZero())
+}
+
+func Test_parseRaw_empty(t *testing.T) {
+	_, err := parseRaw(" \n")
+	assert.Equal(t, errEmptyMessage, err)
+}
+
+func Test_parseRFC5424_nil_timestamp(t *testing.T) {
+	parsed, err := parseRFC5424("<34>1 - host app - - - msg")
+	assert.Nil(t, err)
+	assert.True(t, parsed.timestamp.IsZero())
+}
+
+// Assert that nested fields can be rendered.
+func Test_parseJSON_render(t *testing.T) {
+	parsed, err := parseJSON(`{"level": "warn", "request": {"id": 123456789}}`)
+	assert.Nil(t, err)
+	buf := bytes.NewBuffer([]byte{})
+	tpl, _ := template.New("").Parse(`{{.Fields.level}} {{.Fields.request.id}}`)
+	assert.Nil(t, parsed.render(tpl, buf))
+	assert.Equal(t, "warn 123456789", buf.String())
+}
+
+func Test_parseJSON_invalid(t *testing.T) {
+	for _, msg := range []string{"plain line", "[1, 2]", "null", `{"unterminated": `} {
+		_, err := parseJSON(msg)
+		assert.Equal(t, errUnknownMessageFormat, err, msg)
+	}
+}
+
+func Test_parseJSON_empty(t *testing.T) {
+	_, err := parseJSON("  ")
+	assert.Equal(t, errEmptyMessage, err)
+}
+
+func Test_newParser_json_message(t *testing.T) {
+	parsefn := newParser(&FlowCfg{SyslogFormat: formatRFC3164, JSONMessage: true})
+	parsed, err := parsefn(`<86>Jul 23 14:48:16 debian app: {"level": "info"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"level": "info"}, parsed.Fields)
+}
+
+// Assert that syslog messages with non JSON body are passed on.
+func Test_newParser_json_message_plain(t *testing.T) {
+	parsefn := newParser(&FlowCfg{SyslogFormat: formatRFC3164, JSONMessage: true})
+	parsed, err := parsefn("<86>Jul 23 14:48:16 debian app: plain message")
+	assert.Nil(t, err)
+	assert.Nil(t, parsed.Fields)
+}
+
+func Test_newParser_json_time(t *testing.T) {
+	for layout, msg := range map[string]string{
+		time.RFC3339Nano: `{"meta": {"ts": "2017-05-01T10:00:00.250Z"}}`,
+		unixTimeLayout:   `{"meta": {"ts": 1493632800.25}}`,
+		unixMsTimeLayout: `{"meta": {"ts": 1493632800250}}`,
+	} {
+		parsefn := newParser(&FlowCfg{SyslogFormat: formatJSON, JSONTimeKey: "meta.ts", JSONTimeLayout: layout})
+		parsed, err := parsefn(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1493632800250), parsed.timestamp.UnixNano()/int64(time.Millisecond), layout)
+	}
+}
+
+// Assert that message timestamp is kept when JSON field is missing or invalid.
+func Test_newParser_json_time_invalid(t *testing.T) {
+	parsefn := newParser(&FlowCfg{SyslogFormat: formatJSON, JSONTimeKey: "ts", JSONTimeLayout: time.RFC3339})
+	for _, msg := range []string{`{"other": 1}`, `{"ts": "yesterday"}`} {
+		parsed, err := parsefn(msg)
+		assert.Nil(t, err)
+		assert.True(t, parsed.timestamp.IsZero())
+	}
+}
+
+func Test_lookupField(t *testing.T) {
+	fields := map[string]interface{}{"a": map[string]interface{}{"b": "c"}, "d": "e"}
+	value, ok := lookupField(fields, "a.b")
+	assert.True(t, ok)
+	assert.Equal(t, "c", value)
+	_, ok = lookupField(fields, "d.b")
+	assert.False(t, ok)
+}
+
+// Assert that zoneless timestamps are interpreted in flow timezone.
+func Test_newParser_timezone(t *testing.T) {
+	parsefn := newParser(&FlowCfg{SyslogFormat: formatRFC3164, Timezone: "America/New_York"})
+	parsed, err := parsefn("<13>Jul 23 14:48:16 host tag: msg")
+	assert.Nil(t, err)
+	loc, _ := time.LoadLocation("America/New_York")
+	assert.Equal(t, loc, parsed.timestamp.Location())
+	assert.Equal(t, 18, parsed.timestamp.UTC().Hour())
+}
+
+// Assert that timestamps with explicit time zone are not changed.
+func Test_newParser_timezone_explicit(t *testing.T) {
+	for format, msg := range map[string]string{
+		formatRFC3164: "<13>2017-07-23T14:48:16Z host tag: msg",
+		formatRFC5424: "<13>1 2017-07-23T14:48:16Z host app - - - msg",
+	} {
+		parsefn := newParser(&FlowCfg{SyslogFormat: format, Timezone: "America/New_York"})
+		parsed, err := parsefn(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, 14, parsed.timestamp.UTC().Hour(), format)
+	}
+}
+
+func Test_newParser_json_time_timezone(t *testing.T) {
+	parsefn := newParser(&FlowCfg{
+		SyslogFormat:   formatJSON,
+		JSONTimeKey:    "ts",
+		JSONTimeLayout: "2006-01-02 15:04:05",
+		Timezone:       "America/New_York",
+	})
+	parsed, err := parsefn(`{"ts": "2017-07-23 14:48:16"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, 18, parsed.timestamp.UTC().Hour())
+}
+
+// Assert that UTC is used by default.
+func Test_newParser_timezone_default(t *testing.T) {
+	parsed, _ := newParser(&FlowCfg{SyslogFormat: formatRFC3164})("<13>Jul 23 14:48:16 host tag: msg")
+	assert.Equal(t, time.UTC, parsed.timestamp.Location())
+}
@@ -1,9 +1,33 @@
 package main
 
 import (
+	"math"
 	"sort"
+	"time"
 )
 
+const (
+	overflowDropNewest = "drop_newest"
+	overflowDropOldest = "drop_oldest"
+	overflowBlock      = "block"
+
+	windowDropOption  = "drop"
+	windowClampOption = "clamp"
+	// Upload happens a bit after the window is checked.
+	windowMargin = time.Minute
+)
+
+var validWindowOptions = []string{
+	windowDropOption,
+	windowClampOption,
+}
+
+var validOverflowPolicies = []string{
+	overflowDropNewest,
+	overflowDropOldest,
+	overflowBlock,
+}
+
 type eventsList []logEvent
 
 // Calculate size including each event overhead.
@@ -23,24 +47,216 @@ func (m eventsList) Swap(i, j int) {
 }
 
 func (m eventsList) Less(i, j int) bool {
+	if m[i].timestamp == m[j].timestamp {
+		return m[i].seq < m[j].seq
+	}
 	return m[i].timestamp < m[j].timestamp
 }
 
+// Queue of events waiting for upload.
+type batchQueue interface {
+	// Add newly received events
+	add(events ...logEvent)
+	// Return events from failed upload which will be retried
+	putBack(events ...logEvent)
+	// Remove and return events for next upload
+	getBatch() eventsList
+	// Mark events from batch as uploaded or discarded
+	done(batch eventsList)
+	empty() bool
+	num() int
+	// Whether adding more events would exceed queue limit
+	full() bool
+	// Number of events discarded or changed by queue
+	stats() queueStats
+	// Whether queued events survive restart
+	durable() bool
+	// Write queued events to durable storage when due
+	sync()
+	close()
+}
+
+// Number of events discarded or changed by queue per reason.
+type queueStats struct {
+	// Dropped because queue was full
+	overflow uint64
+	// Older than accepted by CloudWatch
+	tooOld uint64
+	// Further in the future than accepted by CloudWatch
+	tooNew uint64
+}
+
+// Create a memory queue, backed by spool when spool_dir is set.
+func newQueue(cfg *FlowCfg) (batchQueue, error) {
+	maxBytes, _ := parseByteSize(cfg.QueueMaxBytes)
+	mem := &eventQueue{
+		max_size:  cfg.QueueSize,
+		max_bytes: maxBytes,
+		policy:    cfg.OverflowPolicy,
+		window: &eventWindow{
+			maxAge:    cfg.MaxEventAge,
+			maxFuture: cfg.MaxEventFuture,
+			clamp:     cfg.OutOfWindow == windowClampOption,
+		},
+	}
+	if cfg.SpoolDir == "" {
+		return mem, nil
+	}
+	return newDiskQueue(cfg.SpoolDir, cfg.SpoolSegmentSize, cfg.SpoolFsync, mem)
+}
+
+/*
+Memory only queue. When max_size events or max_bytes (if not 0) are reached,
+events are discarded according to policy. With block policy events are always
+added, the caller is expected to stop adding events while queue is full.
+Events outside of window are removed or clamped before batching.
+*/
 type eventQueue struct {
-	events   eventsList
-	max_size queue_size
+	events    eventsList
+	max_size  queue_size
+	max_bytes int64
+	// Size of all queued events.
+	bytes  int64
+	policy string
+	window *eventWindow
+	// Called with events removed because of window.
+	release func(eventsList)
+	counts  queueStats
+}
+
+func (q *eventQueue) add(events ...logEvent) {
+	q.push(events...)
+	q.trim()
+}
+
+// Events from failed upload are the oldest ones, so they are put in front.
+func (q *eventQueue) putBack(events ...logEvent) {
+	q.events = append(append(eventsList{}, events...), q.events...)
+	q.bytes += int64(eventsList(events).size())
+	q.trim()
+}
+
+// Add events regardless of limits.
+func (q *eventQueue) push(events ...logEvent) {
+	q.events = append(q.events, events...)
+	q.bytes += int64(eventsList(events).size())
+}
+
+// Discard events over limits.
+func (q *eventQueue) trim() {
+	if q.policy == overflowBlock {
+		return
+	}
+	over, bytes := 0, q.bytes
+	for over < len(q.events) && q.exceeds(len(q.events)-over, bytes) {
+		bytes -= int64(q.discarded(over).size())
+		over++
+	}
+	if over == 0 {
+		return
+	}
+	if q.policy == overflowDropOldest {
+		q.events = q.events[over:]
+	} else {
+		q.events = q.events[:len(q.events)-over]
+	}
+	q.bytes = bytes
+	q.counts.overflow += uint64(over)
 }
 
-func (q *eventQueue) add(event ...logEvent) {
-	left := int(q.max_size) - len(q.events)
-	many := event[:min(left, len(event))]
-	q.events = append(q.events, many...)
+func (q *eventQueue) exceeds(count int, bytes int64) bool {
+	return count > int(q.max_size) || (q.max_bytes > 0 && bytes > q.max_bytes)
 }
 
+// Return n-th event to be discarded according to policy.
+func (q *eventQueue) discarded(n int) *logEvent {
+	if q.policy == overflowDropOldest {
+		return &q.events[n]
+	}
+	return &q.events[len(q.events)-1-n]
+}
+
+func (q *eventQueue) full() bool {
+	if q.max_bytes > 0 && q.bytes >= q.max_bytes {
+		return true
+	}
+	return len(q.events) >= int(q.max_size)
+}
+
+func (q *eventQueue) stats() queueStats {
+	return q.counts
+}
+
+func (q *eventQueue) done(batch eventsList) {}
+
+func (q *eventQueue) durable() bool {
+	return false
+}
+
+func (q *eventQueue) sync() {}
+
+func (q *eventQueue) close() {}
+
 func (q *eventQueue) getBatch() (batch eventsList) {
 	sort.Sort(q.events)
+	q.applyWindow(time.Now())
+	if len(q.events) == 0 {
+		return
+	}
 	index := numEvents(q.events, sizeIndex, timeIndex)
 	batch, q.events = q.events[:index], q.events[index:]
+	q.bytes -= int64(batch.size())
+	return
+}
+
+// Remove or clamp sorted events outside of window.
+func (q *eventQueue) applyWindow(now time.Time) {
+	if q.window == nil {
+		return
+	}
+	oldest, newest := q.window.bounds(now)
+	old := sort.Search(len(q.events), func(i int) bool {
+		return q.events[i].timestamp >= oldest
+	})
+	newer := sort.Search(len(q.events), func(i int) bool {
+		return q.events[i].timestamp > newest
+	})
+	q.counts.tooOld += uint64(old)
+	q.counts.tooNew += uint64(len(q.events) - newer)
+	if q.window.clamp {
+		for i := range q.events[:old] {
+			q.events[i].timestamp = oldest
+		}
+		for i := range q.events[newer:] {
+			q.events[newer+i].timestamp = newest
+		}
+		return
+	}
+	outside := append(q.events[:old:old], q.events[newer:]...)
+	q.events = q.events[old:newer]
+	q.bytes -= int64(outside.size())
+	if q.release != nil && len(outside) > 0 {
+		q.release(outside)
+	}
+}
+
+// Range of event timestamps accepted by CloudWatch. Zero duration disables check.
+type eventWindow struct {
+	maxAge    time.Duration
+	maxFuture time.Duration
+	// Set timestamps outside of window to its bounds instead of removing events.
+	clamp bool
+}
+
+// Return oldest and newest accepted timestamp in milliseconds.
+func (w *eventWindow) bounds(now time.Time) (oldest, newest int64) {
+	oldest, newest = math.MinInt64, math.MaxInt64
+	if w.maxAge > 0 {
+		oldest = toMillis(now.Add(-w.maxAge + windowMargin))
+	}
+	if w.maxFuture > 0 {
+		newest = toMillis(now.Add(w.maxFuture - windowMargin))
+	}
 	return
 }
 
@@ -3,6 +3,7 @@ package main
 import (
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -46,6 +47,68 @@ func Test_queue_sorted_batch(t *testing.T) {
 	assert.Equal(t, logEvent{timestamp: 1}, queue.getBatch()[0])
 }
 
+// Assert that newest events are dropped and counted by default.
+func Test_queue_drop_newest(t *testing.T) {
+	queue := &eventQueue{max_size: 2}
+	queue.add(logEvent{seq: 1}, logEvent{seq: 2}, logEvent{seq: 3})
+	assert.Equal(t, eventsList{{seq: 1}, {seq: 2}}, queue.events)
+	assert.Equal(t, uint64(1), queue.stats().overflow)
+}
+
+func Test_queue_drop_oldest(t *testing.T) {
+	queue := &eventQueue{max_size: 2, policy: overflowDropOldest}
+	queue.add(logEvent{seq: 1}, logEvent{seq: 2})
+	queue.add(logEvent{seq: 3})
+	assert.Equal(t, eventsList{{seq: 2}, {seq: 3}}, queue.events)
+	assert.Equal(t, uint64(1), queue.stats().overflow)
+}
+
+// Assert that events put back are treated as the oldest ones.
+func Test_queue_putBack_drop_oldest(t *testing.T) {
+	queue := &eventQueue{max_size: 2, policy: overflowDropOldest}
+	queue.add(logEvent{seq: 2}, logEvent{seq: 3})
+	queue.putBack(logEvent{seq: 1})
+	assert.Equal(t, eventsList{{seq: 2}, {seq: 3}}, queue.events)
+}
+
+// Assert that nothing is dropped with block policy.
+func Test_queue_block(t *testing.T) {
+	queue := &eventQueue{max_size: 1, policy: overflowBlock}
+	queue.add(logEvent{seq: 1})
+	assert.True(t, queue.full())
+	queue.add(logEvent{seq: 2})
+	assert.Equal(t, 2, queue.num())
+	assert.Equal(t, uint64(0), queue.stats().overflow)
+}
+
+// Assert that events over byte limit are dropped.
+func Test_queue_max_bytes(t *testing.T) {
+	event := logEvent{msg: "message"}
+	queue := &eventQueue{max_size: 10, max_bytes: int64(2 * event.size())}
+	queue.add(event, event, event)
+	assert.Equal(t, 2, queue.num())
+	assert.Equal(t, int64(2*event.size()), queue.bytes)
+	assert.Equal(t, uint64(1), queue.stats().overflow)
+	assert.True(t, queue.full())
+}
+
+func Test_queue_max_bytes_drop_oldest(t *testing.T) {
+	queue := &eventQueue{max_size: 10, max_bytes: 100, policy: overflowDropOldest}
+	queue.add(logEvent{msg: RandomString(40)}, logEvent{msg: "small"})
+	queue.add(logEvent{msg: RandomString(40)})
+	assert.Equal(t, []int{5, 40}, []int{len(queue.events[0].msg), len(queue.events[1].msg)})
+	assert.Equal(t, int64(queue.events.size()), queue.bytes)
+}
+
+// Assert that bytes of events taken for upload are released.
+func Test_queue_bytes_getBatch(t *testing.T) {
+	queue := &eventQueue{max_size: 10}
+	queue.add(logEvent{msg: "message"})
+	queue.putBack(queue.getBatch()...)
+	queue.getBatch()
+	assert.Equal(t, int64(0), queue.bytes)
+}
+
 // Assert that batch size does not exceed its allowed maximum
 func Test_sizeIndex_multi(t *testing.T) {
 	events := eventsList{
@@ -113,3 +176,59 @@ func Test_eventList_Sort(t *testing.T) {
 	sort.Sort(to_sort)
 	assert.Equal(t, sorted, to_sort)
 }
+
+// Assert that arrival order is kept for events with equal timestamps.
+func Test_eventList_Sort_seq(t *testing.T) {
+	sorted := eventsList{
+		logEvent{timestamp: 1, seq: 3},
+		logEvent{timestamp: 2, seq: 1},
+		logEvent{timestamp: 2, seq: 2},
+	}
+	to_sort := eventsList{
+		logEvent{timestamp: 2, seq: 2},
+		logEvent{timestamp: 2, seq: 1},
+		logEvent{timestamp: 1, seq: 3},
+	}
+	sort.Sort(to_sort)
+	assert.Equal(t, sorted, to_sort)
+}
+
+func Test_eventWindow_bounds(t *testing.T) {
+	now := time.Unix(100000, 0)
+	window := eventWindow{maxAge: time.Hour, maxFuture: time.Hour}
+	oldest, newest := window.bounds(now)
+	assert.Equal(t, toMillis(now.Add(-time.Hour+windowMargin)), oldest)
+	assert.Equal(t, toMillis(now.Add(time.Hour-windowMargin)), newest)
+}
+
+// Assert that events outside of window are removed and released.
+func Test_queue_applyWindow_drop(t *testing.T) {
+	now := time.Now()
+	var released eventsList
+	queue := &eventQueue{
+		max_size: 10,
+		window:   &eventWindow{maxAge: time.Hour, maxFuture: time.Hour},
+		release:  func(events eventsList) { released = events },
+	}
+	queue.add(
+		logEvent{timestamp: toMillis(now.Add(-2 * time.Hour))},
+		logEvent{timestamp: toMillis(now)},
+		logEvent{timestamp: toMillis(now.Add(2 * time.Hour))},
+	)
+	batch := queue.getBatch()
+	assert.Equal(t, eventsList{{timestamp: toMillis(now)}}, batch)
+	assert.Equal(t, 2, len(released))
+	assert.Equal(t, queueStats{tooOld: 1, tooNew: 1}, queue.stats())
+	assert.Equal(t, int64(0), queue.bytes)
+}
+
+func Test_queue_applyWindow_clamp(t *testing.T) {
+	now := time.Now()
+	window := &eventWindow{maxAge: time.Hour, maxFuture: time.Hour, clamp: true}
+	queue := &eventQueue{max_size: 10, window: window}
+	queue.add(logEvent{timestamp: 0}, logEvent{timestamp: toMillis(now.Add(24 * time.Hour))})
+	queue.applyWindow(now)
+	oldest, newest := window.bounds(now)
+	assert.Equal(t, eventsList{{timestamp: oldest}, {timestamp: newest}}, queue.events)
+	assert.Equal(t, queueStats{tooOld: 1, tooNew: 1}, queue.stats())
+}
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/url"
+	"os"
+	"os/user"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -13,13 +24,23 @@ type receiver interface {
 	// Close connection and channels
 	Close()
 	// Run a goroutine and pass read messages to channel
-	Receive() <-chan string
+	Receive() <-chan receivedMessage
 	// Listen for incoming packets
 	Listen() error
 }
 
+// Message read from socket along with its sender details.
+type receivedMessage struct {
+	msg string
+	// Authenticated peer identity (TLS only)
+	peer string
+	// Sender IP address, empty for unix sockets
+	host string
+	time time.Time
+}
+
 type UDPreceiver struct {
-	conn *net.UDPConn
+	conn net.PacketConn
 	url  *url.URL
 	wg   *sync.WaitGroup
 }
@@ -37,37 +58,496 @@ func (rec *UDPreceiver) Listen() error {
 		return err
 	}
 	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
 	rec.conn = conn
-	return err
+	return nil
 }
 
-func (rec *UDPreceiver) Receive() <-chan string {
-	out := make(chan string, maxBatchEvents)
+func (rec *UDPreceiver) Receive() <-chan receivedMessage {
+	out := make(chan receivedMessage, maxBatchEvents)
 	rec.wg.Add(1)
 	go func() {
 		var buf [maxEventSize]byte
 		defer rec.wg.Done()
 		defer close(out)
 		for {
-			n, err := rec.conn.Read(buf[0:])
-			// For more info why string comparison see https://github.com/golang/go/issues/4373
-			if err != nil && strings.Contains(err.Error(), "use of closed network connection") {
+			n, addr, err := rec.conn.ReadFrom(buf[0:])
+			if err != nil && isClosedConn(err) {
 				return
 			} else if err != nil {
 				log.Fatal(err)
 			}
-			out <- string(buf[0:n])
+			out <- receivedMessage{
+				msg:  string(buf[0:n]),
+				host: senderHost(addr),
+				time: time.Now(),
+			}
 		}
 	}()
 	return out
 }
 
-// Create a new receiver based on passed address.
-func newReceiver(address string) receiver {
-	url, _ := url.Parse(address)
+type TCPreceiver struct {
+	listener net.Listener
+	url      *url.URL
+	wg       *sync.WaitGroup
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	closing  bool
+}
+
+func (rec *TCPreceiver) Close() {
+	if rec.listener != nil {
+		rec.listener.Close()
+		rec.mu.Lock()
+		rec.closing = true
+		for conn := range rec.conns {
+			conn.Close()
+		}
+		rec.mu.Unlock()
+		rec.wg.Wait()
+	}
+}
+
+func (rec *TCPreceiver) Listen() error {
+	listener, err := net.Listen("tcp", rec.url.Host)
+	rec.listener = listener
+	return err
+}
+
+func (rec *TCPreceiver) Receive() <-chan receivedMessage {
+	out := make(chan receivedMessage, maxBatchEvents)
+	rec.wg.Add(1)
+	go func() {
+		// All connection handlers must finish before out is closed.
+		handlers := &sync.WaitGroup{}
+		defer rec.wg.Done()
+		defer close(out)
+		defer handlers.Wait()
+		for {
+			conn, err := rec.listener.Accept()
+			if err != nil && isClosedConn(err) {
+				return
+			} else if err != nil {
+				log.Errorf("tcp accept failed: %s", err)
+				continue
+			}
+			if !rec.track(conn) {
+				conn.Close()
+				return
+			}
+			handlers.Add(1)
+			go func() {
+				defer handlers.Done()
+				defer rec.untrack(conn)
+				peer, err := peerIdentity(conn)
+				if err != nil {
+					log.Errorf("connection from %s rejected: %s", conn.RemoteAddr(), err)
+					return
+				}
+				origin := receivedMessage{peer: peer, host: senderHost(conn.RemoteAddr())}
+				readFrames(conn, origin, out)
+			}()
+		}
+	}()
+	return out
+}
+
+// Register connection so that it is closed along with receiver.
+// Returns false when receiver is already closing.
+func (rec *TCPreceiver) track(conn net.Conn) bool {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.closing {
+		return false
+	}
+	if rec.conns == nil {
+		rec.conns = make(map[net.Conn]bool)
+	}
+	rec.conns[conn] = true
+	return true
+}
+
+func (rec *TCPreceiver) untrack(conn net.Conn) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	delete(rec.conns, conn)
+	conn.Close()
+}
+
+// TLS encrypted syslog receiver https://tools.ietf.org/html/rfc5425
+type TLSreceiver struct {
+	TCPreceiver
+	settings tlsSettings
+}
+
+func (rec *TLSreceiver) Listen() error {
+	config, err := rec.settings.serverConfig()
+	if err != nil {
+		return err
+	}
+	listener, err := tls.Listen("tcp", rec.url.Host, config)
+	if err != nil {
+		return err
+	}
+	rec.listener = listener
+	return nil
+}
+
+type tlsSettings struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientAuth bool
+}
+
+func newTLSSettings(flow *FlowCfg) tlsSettings {
+	return tlsSettings{
+		certFile:   flow.TLSCertFile,
+		keyFile:    flow.TLSKeyFile,
+		caFile:     flow.TLSCAFile,
+		clientAuth: flow.TLSClientAuth,
+	}
+}
+
+func (s tlsSettings) serverConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if s.caFile != "" {
+		pem, err := ioutil.ReadFile(s.caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errInvalidCA
+		}
+		// Certificate is optional, but verified when client sends one.
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if s.clientAuth {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+/*
+Return peer certificate common name or its first subject alternative name.
+For plain connections and clients without certificate an empty string is returned.
+*/
+func peerIdentity(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", nil
+	}
+	if certs[0].Subject.CommonName != "" {
+		return certs[0].Subject.CommonName, nil
+	}
+	for _, names := range [][]string{certs[0].DNSNames, certs[0].EmailAddresses} {
+		if len(names) > 0 {
+			return names[0], nil
+		}
+	}
+	return "", nil
+}
+
+// Datagram unix socket receiver e.g. /dev/log.
+type UnixgramReceiver struct {
+	UDPreceiver
+	socket *socketFile
+}
+
+func (rec *UnixgramReceiver) Close() {
+	rec.UDPreceiver.Close()
+	rec.socket.remove()
+}
+
+func (rec *UnixgramReceiver) Listen() error {
+	if err := rec.socket.removeStale(); err != nil {
+		return err
+	}
+	addr := &net.UnixAddr{Name: rec.socket.path, Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		return err
+	}
+	if err := rec.socket.setup(); err != nil {
+		conn.Close()
+		rec.socket.remove()
+		return err
+	}
+	rec.conn = conn
+	return nil
+}
+
+// Stream unix socket receiver. Framing is the same as for TCP.
+type UnixReceiver struct {
+	TCPreceiver
+	socket *socketFile
+}
+
+func (rec *UnixReceiver) Close() {
+	rec.TCPreceiver.Close()
+	rec.socket.remove()
+}
+
+func (rec *UnixReceiver) Listen() error {
+	if err := rec.socket.removeStale(); err != nil {
+		return err
+	}
+	listener, err := net.Listen("unix", rec.socket.path)
+	if err != nil {
+		return err
+	}
+	if err := rec.socket.setup(); err != nil {
+		listener.Close()
+		rec.socket.remove()
+		return err
+	}
+	rec.listener = listener
+	return nil
+}
+
+// Unix socket file with its permissions and owner.
+type socketFile struct {
+	// unix or unixgram
+	network string
+	path    string
+	mode    os.FileMode
+	owner   string
+}
+
+/*
+Remove socket left by a previous run. Socket is stale only when connecting
+to it is refused, sockets of running processes and other file types are
+not touched.
+*/
+func (s *socketFile) removeStale() error {
+	info, err := os.Lstat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errNotSocket
+	}
+	conn, err := net.Dial(s.network, s.path)
+	if err == nil {
+		conn.Close()
+		return errAddressInUse
+	}
+	if !isConnRefused(err) {
+		return fmt.Errorf("%s: %s", errAddressInUse, err)
+	}
+	return os.Remove(s.path)
+}
+
+func isConnRefused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	return ok && sysErr.Err == syscall.ECONNREFUSED
+}
+
+func (s *socketFile) remove() {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		log.Errorf("could not remove socket %s: %s", s.path, err)
+	}
+}
+
+// Set socket permissions and owner.
+func (s *socketFile) setup() error {
+	if s.mode != 0 {
+		if err := os.Chmod(s.path, s.mode); err != nil {
+			return err
+		}
+	}
+	if s.owner == "" {
+		return nil
+	}
+	uid, gid, err := lookupOwner(s.owner)
+	if err != nil {
+		return err
+	}
+	return os.Chown(s.path, uid, gid)
+}
+
+// Return uid and gid for owner in user[:group] format.
+// Group is left unchanged (-1) when not specified.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	names := strings.SplitN(owner, ":", 2)
+	usr, err := user.Lookup(names[0])
+	if err != nil {
+		return
+	}
+	uid, err = strconv.Atoi(usr.Uid)
+	if err != nil || len(names) == 1 {
+		return uid, -1, err
+	}
+	group, err := user.LookupGroup(names[1])
+	if err != nil {
+		return
+	}
+	gid, err = strconv.Atoi(group.Gid)
+	return
+}
+
+const (
+	// Maximum number of digits in octet counting frame header.
+	maxFrameDigits = 8
+	// Longer frames are truncated. Frames over maxEventSize are handled by oversized_message.
+	maxFrameSize = 16 * maxEventSize
+)
+
+/*
+Read messages from stream until it is closed. Both octet counting and
+non-transparent (LF delimited) framing is supported, even mixed within one stream.
+Every message is sent with sender details copied from origin.
+https://tools.ietf.org/html/rfc6587#section-3.4
+*/
+func readFrames(r io.Reader, origin receivedMessage, out chan<- receivedMessage) {
+	reader := bufio.NewReader(r)
+	for {
+		msg, err := readFrame(reader)
+		if msg != "" {
+			origin.msg, origin.time = msg, time.Now()
+			out <- origin
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func readFrame(r *bufio.Reader) (string, error) {
+	if length := frameLength(r); length > 0 {
+		return readOctetCounted(r, length)
+	}
+	return readLine(r)
+}
+
+/*
+Return message length when stream starts with octet counting header, 0 otherwise.
+Header is read byte by byte, so that waiting for more data happens only while
+stream starts with digits.
+*/
+func frameLength(r *bufio.Reader) int {
+	for i := 0; i <= maxFrameDigits; i++ {
+		header, err := r.Peek(i + 1)
+		if err != nil {
+			return 0
+		}
+		char := header[i]
+		if char == ' ' && i > 0 {
+			length, _ := strconv.Atoi(string(header[:i]))
+			return length
+		}
+		if char < '0' || char > '9' || (i == 0 && char == '0') {
+			return 0
+		}
+	}
+	return 0
+}
+
+// Messages longer than maxFrameSize are truncated.
+func readOctetCounted(r *bufio.Reader, length int) (string, error) {
+	if _, err := r.ReadString(' '); err != nil {
+		return "", err
+	}
+	buf := make([]byte, min(length, maxFrameSize))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	_, err := r.Discard(length - len(buf))
+	return string(buf), err
+}
+
+// Lines longer than maxFrameSize are truncated.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line) < maxFrameSize {
+			line = append(line, chunk[:min(len(chunk), maxFrameSize-len(line))]...)
+		}
+		if err != bufio.ErrBufferFull {
+			return strings.TrimRight(string(line), "\r\n"), err
+		}
+	}
+}
+
+// Return IP address of sender. Unix sockets have no meaningful address.
+func senderHost(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP.String()
+	case *net.TCPAddr:
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// For more info why string comparison see https://github.com/golang/go/issues/4373
+func isClosedConn(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// Create a new receiver based on flow source address.
+func newReceiver(flow *FlowCfg) receiver {
+	url, _ := url.Parse(flow.Source)
 	switch url.Scheme {
 	case "udp":
 		return &UDPreceiver{url: url, wg: &sync.WaitGroup{}}
+	case "tcp":
+		return &TCPreceiver{url: url, wg: &sync.WaitGroup{}}
+	case "tls":
+		return &TLSreceiver{
+			TCPreceiver: TCPreceiver{url: url, wg: &sync.WaitGroup{}},
+			settings:    newTLSSettings(flow),
+		}
+	case "unixgram":
+		return &UnixgramReceiver{
+			UDPreceiver: UDPreceiver{url: url, wg: &sync.WaitGroup{}},
+			socket:      newSocketFile(url, flow),
+		}
+	case "unix":
+		return &UnixReceiver{
+			TCPreceiver: TCPreceiver{url: url, wg: &sync.WaitGroup{}},
+			socket:      newSocketFile(url, flow),
+		}
 	}
 	return nil
 }
+
+func newSocketFile(url *url.URL, flow *FlowCfg) *socketFile {
+	mode, _ := strconv.ParseUint(flow.SocketMode, 8, 32)
+	return &socketFile{
+		network: url.Scheme,
+		path:    socketPath(url),
+		mode:    os.FileMode(mode),
+		owner:   flow.SocketOwner,
+	}
+}
+
+// Both unix:///absolute/path and unix://relative/path are accepted.
+func socketPath(url *url.URL) string {
+	return url.Host + url.Path
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func collectFrames(stream string) (msgs []string) {
+	out := make(chan receivedMessage, 10)
+	readFrames(strings.NewReader(stream), receivedMessage{}, out)
+	close(out)
+	for received := range out {
+		msgs = append(msgs, received.msg)
+	}
+	return
+}
+
+func Test_readFrames_newline(t *testing.T) {
+	msgs := collectFrames("<86>first\n<86>second\r\n\n<86>third")
+	assert.Equal(t, []string{"<86>first", "<86>second", "<86>third"}, msgs)
+}
+
+func Test_readFrames_octet_counting(t *testing.T) {
+	msgs := collectFrames("9 <86>first10 <86>second")
+	assert.Equal(t, []string{"<86>first", "<86>second"}, msgs)
+}
+
+// Assert that both framing methods can be mixed within one stream.
+func Test_readFrames_mixed(t *testing.T) {
+	msgs := collectFrames("9 <86>first<86>second\n2017-01-01 is not a frame\n")
+	assert.Equal(t, []string{"<86>first", "<86>second", "2017-01-01 is not a frame"}, msgs)
+}
+
+// Assert that truncated octet counting frame is not passed on.
+func Test_readFrames_octet_counting_truncated(t *testing.T) {
+	msgs := collectFrames("100 <86>first")
+	assert.Empty(t, msgs)
+}
+
+// Assert that frames over event size are passed on for oversized_message handling.
+func Test_readFrames_over_event_size(t *testing.T) {
+	long := RandomString(maxEventSize + 10)
+	msgs := collectFrames(long + "\n" + strconv.Itoa(len(long)) + " " + long)
+	assert.Equal(t, []string{long, long}, msgs)
+}
+
+func Test_readFrames_too_long(t *testing.T) {
+	msgs := collectFrames(RandomString(maxFrameSize+10) + "\nshort\n")
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, maxFrameSize, len(msgs[0]))
+	assert.Equal(t, "short", msgs[1])
+}
+
+// Assert that frames shorter than octet counting header are delivered while connection is open.
+func Test_readFrames_short_frame_open_connection(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	out := make(chan receivedMessage, 10)
+	go readFrames(server, receivedMessage{}, out)
+	for _, frame := range []string{"<1>hi\n", "3 abc"} {
+		client.Write([]byte(frame))
+		select {
+		case received := <-out:
+			assert.Contains(t, []string{"<1>hi", "abc"}, received.msg)
+		case <-time.After(time.Second):
+			t.Fatalf("frame %q not delivered", frame)
+		}
+	}
+}
+
+func Test_newReceiver_types(t *testing.T) {
+	for source, expected := range map[string]receiver{
+		"udp://localhost:5514": &UDPreceiver{},
+		"tcp://localhost:5514": &TCPreceiver{},
+		"tls://localhost:6514": &TLSreceiver{},
+		"unixgram:///dev/log":  &UnixgramReceiver{},
+		"unix:///run/app.sock": &UnixReceiver{},
+	} {
+		assert.IsType(t, expected, newReceiver(&FlowCfg{Source: source}))
+	}
+}
+
+func Test_newReceiver_socket_file(t *testing.T) {
+	flow := &FlowCfg{Source: "unix:///run/app.sock", SocketMode: "0660", SocketOwner: "root"}
+	rec := newReceiver(flow).(*UnixReceiver)
+	assert.Equal(t, &socketFile{network: "unix", path: "/run/app.sock", mode: 0660, owner: "root"}, rec.socket)
+}
+
+// Assert that messages from all connections are received and Close drains them.
+func Test_TCPreceiver_receive(t *testing.T) {
+	uri, _ := url.Parse("tcp://127.0.0.1:0")
+	rec := &TCPreceiver{url: uri, wg: &sync.WaitGroup{}}
+	assert.Nil(t, rec.Listen())
+	out := rec.Receive()
+	for _, msg := range []string{"first\n", "6 second"} {
+		conn, err := net.Dial("tcp", rec.listener.Addr().String())
+		assert.Nil(t, err)
+		conn.Write([]byte(msg))
+		conn.Close()
+	}
+	received := []string{(<-out).msg, (<-out).msg}
+	rec.Close()
+	_, opened := <-out
+	assert.False(t, opened)
+	sort.Strings(received)
+	assert.Equal(t, []string{"first", "second"}, received)
+}
+
+func tempSocketPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "receivers")
+	assert.Nil(t, err)
+	return filepath.Join(dir, "test.sock"), func() { os.RemoveAll(dir) }
+}
+
+// Assert that stale socket is replaced and removed on Close.
+func Test_UnixgramReceiver_receive(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+	stale, _ := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	stale.Close()
+	rec := newReceiver(&FlowCfg{Source: "unixgram://" + path, SocketMode: "0600"})
+	assert.Nil(t, rec.Listen())
+	info, _ := os.Stat(path)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	out := rec.Receive()
+	conn, err := net.Dial("unixgram", path)
+	assert.Nil(t, err)
+	conn.Write([]byte("<86>message"))
+	conn.Close()
+	assert.Equal(t, "<86>message", (<-out).msg)
+	rec.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_UnixReceiver_receive(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+	rec := newReceiver(&FlowCfg{Source: "unix://" + path})
+	assert.Nil(t, rec.Listen())
+	out := rec.Receive()
+	conn, err := net.Dial("unix", path)
+	assert.Nil(t, err)
+	conn.Write([]byte("first\nsecond\n"))
+	conn.Close()
+	assert.Equal(t, []string{"first", "second"}, []string{(<-out).msg, (<-out).msg})
+	rec.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Assert that socket is released when setting its owner fails, so that it can be bound again.
+func Test_UnixReceiver_setup_failed(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+	for _, scheme := range []string{"unix", "unixgram"} {
+		rec := newReceiver(&FlowCfg{Source: scheme + "://" + path, SocketOwner: "no-such-user-goforward"})
+		assert.NotNil(t, rec.Listen())
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+		rec = newReceiver(&FlowCfg{Source: scheme + "://" + path})
+		assert.Nil(t, rec.Listen())
+		rec.Close()
+	}
+}
+
+// Assert that regular files are never removed.
+func Test_socketFile_removeStale_regular_file(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+	ioutil.WriteFile(path, []byte{}, 0600)
+	socket := &socketFile{path: path}
+	assert.Equal(t, errNotSocket, socket.removeStale())
+	_, err := os.Stat(path)
+	assert.Nil(t, err)
+}
+
+// Assert that socket of a running listener is not removed.
+func Test_socketFile_removeStale_in_use(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+	for _, network := range []string{"unix", "unixgram"} {
+		var listener io.Closer
+		var err error
+		if network == "unix" {
+			listener, err = net.Listen(network, path)
+		} else {
+			listener, err = net.ListenUnixgram(network, &net.UnixAddr{Name: path, Net: network})
+		}
+		assert.Nil(t, err)
+		socket := &socketFile{network: network, path: path}
+		assert.Equal(t, errAddressInUse, socket.removeStale())
+		_, err = os.Stat(path)
+		assert.Nil(t, err)
+		listener.Close()
+		os.Remove(path)
+	}
+}
+
+func Test_lookupOwner(t *testing.T) {
+	uid, gid, err := lookupOwner("root:root")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0, 0}, []int{uid, gid})
+	_, gid, _ = lookupOwner("root")
+	assert.Equal(t, -1, gid)
+}
+
+// Assert that client certificate identity is passed along with message.
+func Test_TLSreceiver_peer_identity(t *testing.T) {
+	pki, cleanup := newTestPKI(t)
+	defer cleanup()
+	rec := newReceiver(&FlowCfg{
+		Source:        "tls://127.0.0.1:0",
+		TLSCertFile:   pki.serverCert,
+		TLSKeyFile:    pki.serverKey,
+		TLSCAFile:     pki.caCert,
+		TLSClientAuth: true,
+	}).(*TLSreceiver)
+	assert.Nil(t, rec.Listen())
+	out := rec.Receive()
+	conn, err := tls.Dial("tcp", rec.listener.Addr().String(), pki.clientConfig)
+	assert.Nil(t, err)
+	conn.Write([]byte("<86>message\n"))
+	conn.Close()
+	received := <-out
+	assert.Equal(t, "<86>message", received.msg)
+	assert.Equal(t, "client.example.com", received.peer)
+	assert.Equal(t, "127.0.0.1", received.host)
+	rec.Close()
+}
+
+// Assert that client certificate is verified and passed along when CA is set without required authentication.
+func Test_TLSreceiver_optional_client_cert(t *testing.T) {
+	pki, cleanup := newTestPKI(t)
+	defer cleanup()
+	rec := newReceiver(&FlowCfg{
+		Source:      "tls://127.0.0.1:0",
+		TLSCertFile: pki.serverCert,
+		TLSKeyFile:  pki.serverKey,
+		TLSCAFile:   pki.caCert,
+	}).(*TLSreceiver)
+	assert.Nil(t, rec.Listen())
+	out := rec.Receive()
+	for _, config := range []*tls.Config{pki.clientConfig, {RootCAs: pki.clientConfig.RootCAs}} {
+		conn, err := tls.Dial("tcp", rec.listener.Addr().String(), config)
+		assert.Nil(t, err)
+		conn.Write([]byte("<86>message\n"))
+		conn.Close()
+	}
+	peers := []string{(<-out).peer, (<-out).peer}
+	sort.Strings(peers)
+	assert.Equal(t, []string{"", "client.example.com"}, peers)
+	rec.Close()
+}
+
+// Assert that clients without certificate are rejected when client authentication is required.
+func Test_TLSreceiver_client_auth_required(t *testing.T) {
+	pki, cleanup := newTestPKI(t)
+	defer cleanup()
+	rec := newReceiver(&FlowCfg{
+		Source:        "tls://127.0.0.1:0",
+		TLSCertFile:   pki.serverCert,
+		TLSKeyFile:    pki.serverKey,
+		TLSCAFile:     pki.caCert,
+		TLSClientAuth: true,
+	}).(*TLSreceiver)
+	assert.Nil(t, rec.Listen())
+	out := rec.Receive()
+	config := &tls.Config{RootCAs: pki.clientConfig.RootCAs}
+	conn, err := tls.Dial("tcp", rec.listener.Addr().String(), config)
+	if err == nil {
+		conn.Write([]byte("<86>message\n"))
+		conn.Close()
+	}
+	rec.Close()
+	_, opened := <-out
+	assert.False(t, opened)
+}
+
+// Assert that sender address and receive time are passed along with message.
+func Test_UDPreceiver_origin(t *testing.T) {
+	uri, _ := url.Parse("udp://127.0.0.1:0")
+	rec := &UDPreceiver{url: uri, wg: &sync.WaitGroup{}}
+	assert.Nil(t, rec.Listen())
+	out := rec.Receive()
+	conn, err := net.Dial("udp", rec.conn.LocalAddr().String())
+	assert.Nil(t, err)
+	conn.Write([]byte("plain line"))
+	conn.Close()
+	received := <-out
+	rec.Close()
+	assert.Equal(t, "plain line", received.msg)
+	assert.Equal(t, "127.0.0.1", received.host)
+	assert.WithinDuration(t, time.Now(), received.time, time.Second)
+}
+
+func Test_senderHost_unix(t *testing.T) {
+	assert.Equal(t, "", senderHost(&net.UnixAddr{Name: "@", Net: "unixgram"}))
+	assert.Equal(t, "", senderHost(nil))
+}
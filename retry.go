@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const (
+	// Delay before first retry. Doubled with each following attempt.
+	retryBaseDelay = putLogEventsDelay
+	// Upper bound of delay between retries.
+	retryMaxDelay = time.Minute
+)
+
+// Error codes after which the same request may succeed later.
+var retryableCodes = map[string]bool{
+	"RequestError":                true,
+	"RequestTimeout":              true,
+	"Throttling":                  true,
+	"ThrottlingException":         true,
+	"ServiceUnavailableException": true,
+	"ServiceUnavailable":          true,
+	"InternalFailure":             true,
+	"OperationAbortedException":   true,
+}
+
+// Whether failed upload may succeed when retried without any change.
+func isRetryable(result error) bool {
+	switch err := result.(type) {
+	case awserr.RequestFailure:
+		if retryableCodes[err.Code()] {
+			return true
+		}
+		return err.StatusCode() == http.StatusTooManyRequests || err.StatusCode() >= http.StatusInternalServerError
+	case awserr.Error:
+		return retryableCodes[err.Code()]
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+/*
+Retry state of failing uploads to destination.
+Retries are spaced with exponential backoff and jitter. Batch which keeps
+failing for longer than maxAge is dropped. Zero maxAge retries forever.
+*/
+type backoff struct {
+	maxAge   time.Duration
+	attempts uint
+	// When current batch failed for the first time.
+	since time.Time
+	next  time.Time
+}
+
+// Schedule next attempt. Returns false when retries took longer than maxAge.
+func (b *backoff) failed(now time.Time) bool {
+	if b.since.IsZero() {
+		b.since = now
+	}
+	if b.maxAge > 0 && now.Sub(b.since) > b.maxAge {
+		b.reset()
+		return false
+	}
+	b.attempts++
+	b.next = now.Add(b.delay())
+	return true
+}
+
+func (b *backoff) reset() {
+	*b = backoff{maxAge: b.maxAge}
+}
+
+// Whether next attempt may be made.
+func (b *backoff) ready(now time.Time) bool {
+	return !now.Before(b.next)
+}
+
+// Return delay between half and full of exponentially growing delay.
+func (b *backoff) delay() time.Duration {
+	delay := retryMaxDelay
+	if b.attempts < 16 {
+		if exp := retryBaseDelay << (b.attempts - 1); exp < delay {
+			delay = exp
+		}
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_isRetryable(t *testing.T) {
+	for err, expected := range map[error]bool{
+		awserr.New("ThrottlingException", "rate exceeded", nil):                                true,
+		awserr.New("RequestError", "send request failed", nil):                                 true,
+		awserr.NewRequestFailure(awserr.New("ServiceUnavailableException", "", nil), 503, ""):  true,
+		awserr.NewRequestFailure(awserr.New("UnknownError", "", nil), 502, ""):                 true,
+		awserr.New("InvalidParameterException", "invalid", nil):                                false,
+		awserr.NewRequestFailure(awserr.New("UnrecognizedClientException", "", nil), 400, ""):  false,
+		awserr.NewRequestFailure(awserr.New("DataAlreadyAcceptedException", "", nil), 400, ""): false,
+		errors.New("unknown"): false,
+	} {
+		assert.Equal(t, expected, isRetryable(err), err.Error())
+	}
+}
+
+// Assert that delay grows exponentially within jitter bounds.
+func Test_backoff_delay(t *testing.T) {
+	b := backoff{}
+	for attempt := uint(1); attempt <= 3; attempt++ {
+		b.attempts = attempt
+		full := retryBaseDelay << (attempt - 1)
+		delay := b.delay()
+		assert.True(t, delay >= full/2 && delay <= full, delay.String())
+	}
+}
+
+func Test_backoff_delay_max(t *testing.T) {
+	b := backoff{attempts: 100}
+	assert.True(t, b.delay() <= retryMaxDelay)
+}
+
+func Test_backoff_failed(t *testing.T) {
+	now := time.Now()
+	b := backoff{maxAge: time.Minute}
+	assert.True(t, b.failed(now))
+	assert.False(t, b.ready(now))
+	assert.True(t, b.ready(now.Add(retryBaseDelay)))
+	assert.False(t, b.failed(now.Add(2*time.Minute)))
+	// State is reset for next batch
+	assert.Equal(t, backoff{maxAge: time.Minute}, b)
+}
+
+func Test_backoff_forever(t *testing.T) {
+	now := time.Now()
+	b := backoff{}
+	b.failed(now)
+	assert.True(t, b.failed(now.Add(24*time.Hour)))
+}
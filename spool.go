@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	segmentExt = ".seg"
+	// Segment being compacted, renamed to segment once written.
+	compactFile = "compact.tmp"
+	// Record length and CRC32 of its payload.
+	recordHeaderSize = 8
+	// Record timestamp and sequence number.
+	recordTimestampSize = 8
+	recordSeqSize       = 8
+	// How often segment is synced with periodic fsync policy.
+	spoolSyncInterval = time.Second
+
+	fsyncAlwaysOption   = "always"
+	fsyncPeriodicOption = "periodic"
+	fsyncNeverOption    = "never"
+)
+
+var validFsyncOptions = []string{
+	fsyncAlwaysOption,
+	fsyncPeriodicOption,
+	fsyncNeverOption,
+}
+
+/*
+Queue which writes every event to append-only segment files before it is
+kept in memory. Only up to memory queue limits are held in memory, the rest is
+read from disk as memory queue drains. A segment is removed after all its
+events were marked as done, so events which were not uploaded are replayed
+after restart. Events may be uploaded twice when process stops between
+upload and segment removal. Spooled events get sequence numbers continuing
+those of previous run, so that events with equal timestamps keep their order.
+*/
+type diskQueue struct {
+	mem            *eventQueue
+	dir            string
+	maxSegmentSize int64
+	fsync          string
+	lastSync       time.Time
+	// Events were written since last sync.
+	unsynced bool
+	// Number of events in segment not yet marked as done.
+	live       map[int]int
+	writeID    int
+	writer     *os.File
+	writeSize  int64
+	readID     int
+	readFile   *os.File
+	reader     *bufio.Reader
+	readOffset int64
+	// Sequence number of next written event.
+	seq uint64
+}
+
+// Open spool directory and replay segments left by previous run.
+func newDiskQueue(dir string, maxSegmentSize int64, fsync string, mem *eventQueue) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	ids, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	q := &diskQueue{
+		mem:            mem,
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+		fsync:          fsync,
+		live:           make(map[int]int),
+	}
+	mem.release = q.done
+	for _, id := range ids {
+		count, last, err := scanSegment(q.segmentPath(id))
+		if err != nil {
+			return nil, err
+		}
+		q.live[id] = count
+		q.writeID = id
+		if count > 0 && last >= q.seq {
+			q.seq = last + 1
+		}
+	}
+	if len(ids) > 0 {
+		log.Infof("spool %s replaying %d segments", dir, len(ids))
+		q.readID = ids[0]
+	}
+	// Never append to segments of previous run as they may end with a partial record.
+	if err := q.rotate(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		q.readID = q.writeID
+	}
+	q.fill()
+	return q, nil
+}
+
+func (q *diskQueue) add(events ...logEvent) {
+	for _, event := range events {
+		event.seq = q.seq
+		q.seq++
+		if err := q.write(event); err != nil {
+			log.Errorf("spool %s write failed, keeping event in memory only: %s", q.dir, err)
+			q.mem.add(event)
+		}
+	}
+	q.sync()
+	q.fill()
+}
+
+// Events are already spooled, so they are put back regardless of memory limit.
+func (q *diskQueue) putBack(events ...logEvent) {
+	q.mem.push(events...)
+}
+
+func (q *diskQueue) getBatch() eventsList {
+	q.fill()
+	return q.mem.getBatch()
+}
+
+// Mark events as no longer needed and remove segments which have no events left.
+func (q *diskQueue) done(batch eventsList) {
+	for _, event := range batch {
+		if event.segment == 0 {
+			continue
+		}
+		q.live[event.segment]--
+		q.cleanup(event.segment)
+	}
+}
+
+func (q *diskQueue) empty() bool {
+	q.fill()
+	return q.mem.empty()
+}
+
+func (q *diskQueue) num() int {
+	q.fill()
+	return q.mem.num()
+}
+
+// Events over memory limit are kept on disk.
+func (q *diskQueue) full() bool {
+	return false
+}
+
+func (q *diskQueue) stats() queueStats {
+	return q.mem.stats()
+}
+
+func (q *diskQueue) durable() bool {
+	return true
+}
+
+func (q *diskQueue) close() {
+	if err := q.compact(); err != nil {
+		log.Errorf("spool %s compaction failed, some events may be uploaded again: %s", q.dir, err)
+	}
+	q.closeReader()
+	if q.writer != nil {
+		q.writer.Sync()
+		q.writer.Close()
+		q.writer = nil
+	}
+}
+
+/*
+Rewrite segment being read so that events already marked as done are not
+replayed after clean shutdown. Pending events of segments read so far are
+all in memory, they are written followed by unread rest of the segment.
+Segments read before are removed, following ones are left untouched.
+On failure old segments are kept.
+*/
+func (q *diskQueue) compact() error {
+	var old []int
+	for id := range q.live {
+		if id < q.readID {
+			old = append(old, id)
+		}
+	}
+	if len(old) == 0 && q.readOffset == 0 && len(q.mem.events) == 0 {
+		return nil
+	}
+	tmp := filepath.Join(q.dir, compactFile)
+	defer os.Remove(tmp)
+	size, err := q.writeCompacted(tmp)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		old = append(old, q.readID)
+	} else if err := os.Rename(tmp, q.segmentPath(q.readID)); err != nil {
+		return err
+	}
+	q.mem.events, q.mem.bytes = nil, 0
+	for _, id := range old {
+		delete(q.live, id)
+		os.Remove(q.segmentPath(id))
+	}
+	return nil
+}
+
+// Write pending events and unread rest of segment being read. Returns written size.
+func (q *diskQueue) writeCompacted(path string) (size int64, err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	for _, event := range q.mem.events {
+		n, err := writer.Write(encodeRecord(event))
+		size += int64(n)
+		if err != nil {
+			return size, err
+		}
+	}
+	unread, err := os.Open(q.segmentPath(q.readID))
+	if err != nil {
+		return
+	}
+	defer unread.Close()
+	if _, err = unread.Seek(q.readOffset, io.SeekStart); err != nil {
+		return
+	}
+	n, err := io.Copy(writer, unread)
+	size += n
+	if err != nil {
+		return
+	}
+	if err = writer.Flush(); err != nil {
+		return
+	}
+	return size, file.Sync()
+}
+
+func (q *diskQueue) write(event logEvent) error {
+	if q.writeSize >= q.maxSegmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := q.writer.Write(encodeRecord(event))
+	q.writeSize += int64(n)
+	if err != nil {
+		// Do not append anything after partially written record.
+		q.rotate()
+		return err
+	}
+	q.live[q.writeID]++
+	q.unsynced = true
+	if q.fsync == fsyncAlwaysOption {
+		return q.writer.Sync()
+	}
+	return nil
+}
+
+// Called on every write and periodically by uploader, so that written events are synced within spoolSyncInterval.
+func (q *diskQueue) sync() {
+	if q.fsync != fsyncPeriodicOption || !q.unsynced || time.Since(q.lastSync) < spoolSyncInterval {
+		return
+	}
+	if err := q.writer.Sync(); err != nil {
+		log.Errorf("spool %s sync failed: %s", q.dir, err)
+	}
+	q.lastSync, q.unsynced = time.Now(), false
+}
+
+// Start writing a new segment and close current one.
+func (q *diskQueue) rotate() error {
+	id := q.writeID + 1
+	file, err := os.OpenFile(q.segmentPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	prevID, prev := q.writeID, q.writer
+	q.writeID, q.writer, q.writeSize = id, file, 0
+	q.live[id] = 0
+	if prev != nil {
+		prev.Sync()
+		prev.Close()
+		q.cleanup(prevID)
+	}
+	return nil
+}
+
+// Load spooled events into memory until it is full. Spooled events are never
+// discarded, so memory limits may be exceeded by the last loaded event.
+func (q *diskQueue) fill() {
+	for !q.mem.full() {
+		event, err := q.next()
+		if err != nil {
+			return
+		}
+		q.mem.push(event)
+	}
+}
+
+// Read next event, moving to following segment when current one is exhausted.
+// io.EOF is returned when all written events were read.
+func (q *diskQueue) next() (event logEvent, err error) {
+	for {
+		if q.readID == q.writeID && q.readOffset >= q.writeSize {
+			return event, io.EOF
+		}
+		if q.reader == nil {
+			if err = q.openReader(); err != nil {
+				log.Errorf("spool %s read failed: %s", q.dir, err)
+				return
+			}
+		}
+		var n int
+		event, n, err = readRecord(q.reader)
+		q.readOffset += int64(n)
+		if err == nil {
+			event.segment = q.readID
+			return
+		}
+		if q.readID == q.writeID {
+			log.Errorf("spool %s read failed: %s", q.dir, err)
+			return
+		}
+		if err != io.EOF {
+			log.Errorf("spool %s segment %d is corrupted, skipping rest of it: %s", q.dir, q.readID, err)
+		}
+		q.closeReader()
+		read := q.readID
+		q.readID = q.nextSegment(read)
+		q.cleanup(read)
+	}
+}
+
+func (q *diskQueue) openReader() error {
+	file, err := os.Open(q.segmentPath(q.readID))
+	if err != nil {
+		return err
+	}
+	q.readFile, q.reader, q.readOffset = file, bufio.NewReader(file), 0
+	return nil
+}
+
+func (q *diskQueue) closeReader() {
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile, q.reader, q.readOffset = nil, nil, 0
+	}
+}
+
+// Return lowest segment id greater than id.
+func (q *diskQueue) nextSegment(id int) int {
+	next := q.writeID
+	for seg := range q.live {
+		if seg > id && seg < next {
+			next = seg
+		}
+	}
+	return next
+}
+
+// Remove segment which was fully read and has no pending events.
+func (q *diskQueue) cleanup(id int) {
+	if id >= q.readID || id == q.writeID || q.live[id] > 0 {
+		return
+	}
+	delete(q.live, id)
+	if err := os.Remove(q.segmentPath(id)); err != nil {
+		log.Errorf("spool %s could not remove segment: %s", q.dir, err)
+	}
+}
+
+func (q *diskQueue) segmentPath(id int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// Return segment ids found in directory in ascending order.
+func listSegments(dir string) (ids []int, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt))
+		if err != nil || id < 1 {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return
+}
+
+// Count valid records and return sequence number of the last one.
+// Reading stops at first partial or corrupted record.
+func scanSegment(path string) (count int, last uint64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		event, _, err := readRecord(reader)
+		if err != nil {
+			return count, last, nil
+		}
+		count++
+		last = event.seq
+	}
+}
+
+/*
+Record layout (big endian):
+
+	length    uint32 length of payload
+	crc       uint32 CRC32 (IEEE) of payload
+	payload:
+	timestamp int64
+	seq       uint64
+	message   []byte
+*/
+func encodeRecord(event logEvent) []byte {
+	size := recordTimestampSize + recordSeqSize + len(event.msg)
+	buf := make([]byte, recordHeaderSize+size)
+	payload := buf[recordHeaderSize:]
+	binary.BigEndian.PutUint64(payload, uint64(event.timestamp))
+	binary.BigEndian.PutUint64(payload[recordTimestampSize:], event.seq)
+	copy(payload[recordTimestampSize+recordSeqSize:], event.msg)
+	binary.BigEndian.PutUint32(buf[0:], uint32(size))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	return buf
+}
+
+// Return decoded event and number of bytes read.
+func readRecord(r io.Reader) (event logEvent, n int, err error) {
+	header := make([]byte, recordHeaderSize)
+	if n, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	size := binary.BigEndian.Uint32(header[0:])
+	if size < recordTimestampSize+recordSeqSize || size > recordTimestampSize+recordSeqSize+maxEventSize {
+		err = errCorruptedRecord
+		return
+	}
+	payload := make([]byte, size)
+	read, err := io.ReadFull(r, payload)
+	n += read
+	if err != nil {
+		return
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		err = errCorruptedRecord
+		return
+	}
+	event.timestamp = int64(binary.BigEndian.Uint64(payload))
+	event.seq = binary.BigEndian.Uint64(payload[recordTimestampSize:])
+	event.msg = string(payload[recordTimestampSize+recordSeqSize:])
+	return
+}
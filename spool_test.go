@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempSpool(t *testing.T, maxSize queue_size, segmentSize int64) (*diskQueue, string) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	q, err := newDiskQueue(dir, segmentSize, fsyncNeverOption, &eventQueue{max_size: maxSize})
+	assert.Nil(t, err)
+	return q, dir
+}
+
+func reopenSpool(t *testing.T, dir string, maxSize queue_size, segmentSize int64) *diskQueue {
+	q, err := newDiskQueue(dir, segmentSize, fsyncNeverOption, &eventQueue{max_size: maxSize})
+	assert.Nil(t, err)
+	return q
+}
+
+func numSegments(dir string) int {
+	ids, _ := listSegments(dir)
+	return len(ids)
+}
+
+func Test_encodeRecord_roundtrip(t *testing.T) {
+	event := logEvent{msg: "message", timestamp: 1500821296123, seq: 42}
+	record := encodeRecord(event)
+	decoded, n, err := readRecord(bytes.NewReader(record))
+	assert.Nil(t, err)
+	assert.Equal(t, len(record), n)
+	assert.Equal(t, event, decoded)
+}
+
+func Test_readRecord_corrupted(t *testing.T) {
+	record := encodeRecord(logEvent{msg: "message"})
+	record[len(record)-1] = 'X'
+	_, _, err := readRecord(bytes.NewReader(record))
+	assert.Equal(t, errCorruptedRecord, err)
+}
+
+func Test_diskQueue_add(t *testing.T) {
+	q, dir := tempSpool(t, 10, defaultSpoolSegmentSize)
+	defer os.RemoveAll(dir)
+	defer q.close()
+	q.add(logEvent{msg: "first", timestamp: 1})
+	q.add(logEvent{msg: "second", timestamp: 2})
+	assert.Equal(t, 2, q.num())
+	batch := q.getBatch()
+	assert.Equal(t, []string{"first", "second"}, []string{batch[0].msg, batch[1].msg})
+	assert.True(t, q.empty())
+}
+
+// Assert that events held as too new are written to spool on close and replayed after restart.
+func Test_closeQueue_held_events(t *testing.T) {
+	q, dir := tempSpool(t, 10, defaultSpoolSegmentSize)
+	defer os.RemoveAll(dir)
+	q.add(logEvent{msg: "first", timestamp: 1})
+	q.add(logEvent{msg: "second", timestamp: 2})
+	batch := q.getBatch()
+	q.done(batch)
+	dst := &destination{maxHeld: 10}
+	dst.hold(batch[1:])
+	closeQueue(dst, q)
+	assert.Empty(t, dst.tooNew)
+
+	q = reopenSpool(t, dir, 10, defaultSpoolSegmentSize)
+	defer q.close()
+	assert.Equal(t, 1, q.num())
+	batch = q.getBatch()
+	assert.Equal(t, "second", batch[0].msg)
+}
+
+// Assert that events over memory limit are kept on disk and loaded as memory drains.
+func Test_diskQueue_overflow_to_disk(t *testing.T) {
+	q, dir := tempSpool(t, 2, defaultSpoolSegmentSize)
+	defer os.RemoveAll(dir)
+	defer q.close()
+	for i := int64(1); i <= 5; i++ {
+		q.add(logEvent{timestamp: i})
+	}
+	var timestamps []int64
+	for !q.empty() {
+		batch := q.getBatch()
+		for _, event := range batch {
+			timestamps = append(timestamps, event.timestamp)
+		}
+		q.done(batch)
+	}
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, timestamps)
+}
+
+// Assert that spooled events are not discarded by memory byte limit.
+func Test_diskQueue_max_bytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	event := logEvent{msg: "message"}
+	mem := &eventQueue{max_size: 100, max_bytes: int64(2*event.size() + 1)}
+	q, err := newDiskQueue(dir, defaultSpoolSegmentSize, fsyncNeverOption, mem)
+	assert.Nil(t, err)
+	defer q.close()
+	for i := int64(1); i <= 6; i++ {
+		q.add(logEvent{msg: "message", timestamp: i})
+	}
+	var timestamps []int64
+	for !q.empty() {
+		batch := q.getBatch()
+		for _, event := range batch {
+			timestamps = append(timestamps, event.timestamp)
+		}
+		q.done(batch)
+	}
+	assert.Equal(t, []int64{1, 2, 3, 4, 5, 6}, timestamps)
+	assert.Equal(t, uint64(0), q.stats().overflow)
+	assert.Equal(t, 0, q.live[q.writeID])
+}
+
+// Assert that events not marked as done are replayed after restart.
+func Test_diskQueue_replay(t *testing.T) {
+	q, dir := tempSpool(t, 10, defaultSpoolSegmentSize)
+	defer os.RemoveAll(dir)
+	q.add(logEvent{msg: "uploaded", timestamp: 1})
+	q.done(q.getBatch())
+	q.add(logEvent{msg: "pending", timestamp: 2})
+	q.close()
+
+	q = reopenSpool(t, dir, 10, defaultSpoolSegmentSize)
+	defer q.close()
+	batch := q.getBatch()
+	assert.Equal(t, 1, len(batch))
+	assert.Equal(t, "pending", batch[0].msg)
+}
+
+// Assert that sequence numbers are kept in spool and continue after restart.
+func Test_diskQueue_seq(t *testing.T) {
+	q, dir := tempSpool(t, 10, defaultSpoolSegmentSize)
+	defer os.RemoveAll(dir)
+	q.add(logEvent{msg: "first", timestamp: 1}, logEvent{msg: "second", timestamp: 1})
+	q.close()
+
+	q = reopenSpool(t, dir, 10, defaultSpoolSegmentSize)
+	defer q.close()
+	q.add(logEvent{msg: "third", timestamp: 1})
+	batch := q.getBatch()
+	assert.Equal(t, []string{"first", "second", "third"}, []string{batch[0].msg, batch[1].msg, batch[2].msg})
+	assert.Equal(t, []uint64{0, 1, 2}, []uint64{batch[0].seq, batch[1].seq, batch[2].seq})
+}
+
+// Assert that done events of partially read segment are not replayed.
+func Test_diskQueue_compact_partial_segment(t *testing.T) {
+	q, dir := tempSpool(t, 1, defaultSpoolSegmentSize)
+	defer os.RemoveAll(dir)
+	for i := int64(1); i <= 3; i++ {
+		q.add(logEvent{timestamp: i})
+	}
+	q.done(q.getBatch())
+	q.close()
+	assert.Equal(t, 1, numSegments(dir))
+
+	q = reopenSpool(t, dir, 10, defaultSpoolSegmentSize)
+	defer q.close()
+	batch := q.getBatch()
+	assert.Equal(t, []int64{2, 3}, []int64{batch[0].timestamp, batch[1].timestamp})
+}
+
+// Assert that segments are removed once all their events are done.
+func Test_diskQueue_segment_cleanup(t *testing.T) {
+	q, dir := tempSpool(t, 10, 1)
+	defer os.RemoveAll(dir)
+	defer q.close()
+	for i := int64(1); i <= 3; i++ {
+		q.add(logEvent{timestamp: i})
+	}
+	assert.Equal(t, 3, numSegments(dir))
+	q.done(q.getBatch())
+	// Segment being written is never removed
+	assert.Equal(t, 1, numSegments(dir))
+}
+
+// Assert that putting events back does not write them again.
+func Test_diskQueue_putBack(t *testing.T) {
+	q, dir := tempSpool(t, 1, defaultSpoolSegmentSize)
+	defer os.RemoveAll(dir)
+	q.add(logEvent{msg: "first", timestamp: 1})
+	q.add(logEvent{msg: "second", timestamp: 2})
+	batch := q.getBatch()
+	q.putBack(batch...)
+	q.close()
+
+	q = reopenSpool(t, dir, 10, defaultSpoolSegmentSize)
+	defer q.close()
+	assert.Equal(t, 2, q.num())
+}
+
+// Assert that partially written record at the end of segment is skipped.
+func Test_diskQueue_partial_record(t *testing.T) {
+	q, dir := tempSpool(t, 10, defaultSpoolSegmentSize)
+	defer os.RemoveAll(dir)
+	q.add(logEvent{msg: "complete", timestamp: 1})
+	q.writer.Write(encodeRecord(logEvent{msg: "partial"})[:10])
+	q.close()
+
+	q = reopenSpool(t, dir, 10, defaultSpoolSegmentSize)
+	defer q.close()
+	batch := q.getBatch()
+	assert.Equal(t, 1, len(batch))
+	assert.Equal(t, "complete", batch[0].msg)
+	q.done(batch)
+	q.add(logEvent{msg: "after restart", timestamp: 2})
+	assert.Equal(t, "after restart", q.getBatch()[0].msg)
+}
+
+// Assert that periodic sync happens without further writes.
+func Test_diskQueue_periodic_sync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	q, err := newDiskQueue(dir, defaultSpoolSegmentSize, fsyncPeriodicOption, &eventQueue{max_size: 10})
+	assert.Nil(t, err)
+	defer q.close()
+	q.lastSync = time.Now()
+	q.add(logEvent{msg: "message"})
+	assert.True(t, q.unsynced)
+	q.lastSync = time.Now().Add(-spoolSyncInterval)
+	q.sync()
+	assert.False(t, q.unsynced)
+}
+
+func Test_newQueue_memory(t *testing.T) {
+	queue, err := newQueue(&FlowCfg{QueueSize: 1})
+	assert.Nil(t, err)
+	assert.False(t, queue.durable())
+}
+
+func Test_newQueue_spool(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+	queue, err := newQueue(&FlowCfg{QueueSize: 1, SpoolDir: dir, SpoolSegmentSize: 1, SpoolFsync: fsyncAlwaysOption})
+	assert.Nil(t, err)
+	defer queue.close()
+	assert.True(t, queue.durable())
+}
+
+// Assert that read segments are compacted on close and unread ones are kept as they are.
+func Test_diskQueue_compact(t *testing.T) {
+	q, dir := tempSpool(t, 1, 1)
+	defer os.RemoveAll(dir)
+	for i := int64(1); i <= 3; i++ {
+		q.add(logEvent{timestamp: i})
+	}
+	q.done(q.getBatch())
+	q.close()
+	assert.Equal(t, 2, numSegments(dir))
+
+	q = reopenSpool(t, dir, 10, 1)
+	defer q.close()
+	batch := q.getBatch()
+	assert.Equal(t, eventsList{{timestamp: 2, seq: 1, segment: batch[0].segment}, {timestamp: 3, seq: 2, segment: batch[1].segment}}, batch)
+}
@@ -16,7 +16,24 @@ type syslogMessage struct {
 	Message   string
 	Syslogtag string
 	Hostname  string
+	// Sender certificate identity for TLS sources
+	PeerName string
+	// Name of parser which recognized the message
+	Format string
+	// RFC3164 TAG split into its parts e.g. sshd[123]:
+	Program string
+	PID     string
+	// RFC5424 specific fields
+	Version        int
+	AppName        string
+	ProcID         string
+	MsgID          string
+	StructuredData map[string]map[string]string
+	// Decoded JSON object for json format and json_message
+	Fields    map[string]interface{}
 	timestamp time.Time
+	// Timestamp was sent without time zone
+	zoneless bool
 }
 
 const maxMsgLen = 2048
@@ -113,6 +130,14 @@ func (f SyslogFacility) String() string {
 	return "UNKNOWN"
 }
 
+// Program name from RFC3164 tag or RFC5424 APP-NAME.
+func (s syslogMessage) tag() string {
+	if s.Program != "" {
+		return s.Program
+	}
+	return s.AppName
+}
+
 func (p SyslogPriority) decode() (SyslogFacility, SyslogSeverity) {
 	return SyslogFacility(p / 8), SyslogSeverity(p % 8)
 }
@@ -121,3 +146,21 @@ func (s syslogMessage) render(tpl *template.Template, buf *bytes.Buffer) error {
 	buf.Reset()
 	return tpl.Execute(buf, s)
 }
+
+// Set sender details and fill values missing from message with those known by receiver.
+func (s *syslogMessage) setOrigin(received receivedMessage) {
+	s.PeerName = received.peer
+	if s.Hostname == "" {
+		s.Hostname = received.host
+	}
+	if s.timestamp.IsZero() {
+		s.timestamp = received.time
+	}
+}
+
+// Replace timestamp with receive time when they differ by more than maxSkew. Zero maxSkew disables it.
+func (s *syslogMessage) clampTimestamp(received time.Time, maxSkew time.Duration) {
+	if maxSkew > 0 && absDuration(s.timestamp.Sub(received)) > maxSkew {
+		s.timestamp = received
+	}
+}
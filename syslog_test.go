@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -71,6 +72,7 @@ func Test_syslogMessage_render_field(t *testing.T) {
 		Hostname:  "hostname",
 		Syslogtag: "tag",
 		Message:   "message",
+		PeerName:  "peer",
 	}
 	for field, expected := range map[string]string{
 		"Severity":  m.Severity.String(),
@@ -78,6 +80,7 @@ func Test_syslogMessage_render_field(t *testing.T) {
 		"Hostname":  m.Hostname,
 		"Syslogtag": m.Syslogtag,
 		"Message":   m.Message,
+		"PeerName":  m.PeerName,
 	} {
 		buf := bytes.NewBuffer([]byte{})
 		tpl, _ := template.New("").Parse(fmt.Sprintf("{{.%s}}", field))
@@ -101,3 +104,41 @@ func Test_syslogMessage_render_reset(t *testing.T) {
 	m.render(tpl, buf)
 	assert.Equal(t, "", buf.String())
 }
+
+// Assert that values missing from message are taken from receiver.
+func Test_syslogMessage_setOrigin_missing(t *testing.T) {
+	now := time.Now()
+	m := syslogMessage{}
+	m.setOrigin(receivedMessage{peer: "peer", host: "10.0.0.1", time: now})
+	assert.Equal(t, syslogMessage{PeerName: "peer", Hostname: "10.0.0.1", timestamp: now}, m)
+}
+
+// Assert that values parsed from message are not overwritten.
+func Test_syslogMessage_setOrigin_present(t *testing.T) {
+	ts := time.Unix(1000, 0)
+	m := syslogMessage{Hostname: "host", timestamp: ts}
+	m.setOrigin(receivedMessage{host: "10.0.0.1", time: time.Now()})
+	assert.Equal(t, "host", m.Hostname)
+	assert.Equal(t, ts, m.timestamp)
+}
+
+func Test_syslogMessage_clampTimestamp(t *testing.T) {
+	received := time.Unix(100000, 0)
+	for ts, expected := range map[time.Time]time.Time{
+		received.Add(-2 * time.Hour): received,
+		received.Add(2 * time.Hour):  received,
+		received.Add(-time.Minute):   received.Add(-time.Minute),
+	} {
+		m := syslogMessage{timestamp: ts}
+		m.clampTimestamp(received, time.Hour)
+		assert.Equal(t, expected, m.timestamp)
+	}
+}
+
+// Assert that zero skew disables clamping.
+func Test_syslogMessage_clampTimestamp_disabled(t *testing.T) {
+	ts := time.Unix(0, 0)
+	m := syslogMessage{timestamp: ts}
+	m.clampTimestamp(time.Now(), 0)
+	assert.Equal(t, ts, m.timestamp)
+}
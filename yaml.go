@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-ini/ini"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	yamlFlowsKey  = "flows"
+	yamlRoutesKey = "routes"
+)
+
+// Options which are comma separated lists in INI file.
+var listKeys = map[string]bool{
+	includeKey:           true,
+	includeFacilitiesKey: true,
+	excludeFacilitiesKey: true,
+	includeTagsKey:       true,
+	excludeTagsKey:       true,
+}
+
+/*
+YAML config has main section and flows mapping flow name to its options.
+Options are named as in INI file, lists are YAML sequences and routes are
+nested in their flow:
+
+	main:
+	  log_level: info
+	flows:
+	  app:
+	    group: app
+	    stream: all
+	    include_tags: [app, web]
+	    routes:
+	      errors:
+	        group: app
+	        stream: errors
+	        min_severity: err
+
+Other nested mappings are flattened by joining keys with underscore, e.g.
+tls: {cert_file: app.pem} is the same as tls_cert_file: app.pem. Flows are
+mapped into INI sections, so defaults and validation are shared with INI.
+*/
+type YamlConfig struct {
+	IniConfig
+}
+
+func isYamlFile(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+type yamlKind uint8
+
+const (
+	yamlScalar yamlKind = iota
+	yamlList
+	yamlMapping
+)
+
+// YAML value with scalars kept as written, so that e.g. socket_mode: 0660 is not read as a number.
+type yamlNode struct {
+	kind    yamlKind
+	text    string
+	list    []yamlNode
+	keys    []string
+	mapping map[string]yamlNode
+}
+
+func (n *yamlNode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&n.text); err == nil {
+		n.kind = yamlScalar
+		return nil
+	}
+	if err := unmarshal(&n.list); err == nil {
+		n.kind = yamlList
+		return nil
+	}
+	// Mapping is read twice to keep order of keys.
+	var order yaml.MapSlice
+	if err := unmarshal(&order); err != nil {
+		return err
+	}
+	if err := unmarshal(&n.mapping); err != nil {
+		return err
+	}
+	n.kind = yamlMapping
+	for _, item := range order {
+		n.keys = append(n.keys, fmt.Sprint(item.Key))
+	}
+	return nil
+}
+
+// Whether node is empty or null, e.g. a section without options.
+func (n yamlNode) empty() bool {
+	return n.kind == yamlScalar && n.text == ""
+}
+
+// Map main and flows into INI sections, routes become sections named route:flow.route.
+func loadYamlFile(file string) (*ini.File, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc yamlNode
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	config := ini.Empty()
+	var errs configErrors
+	if doc.kind != yamlMapping && !doc.empty() {
+		return nil, errMappingExpected
+	}
+	for _, name := range doc.keys {
+		node := doc.mapping[name]
+		switch name {
+		case mainSectionName:
+			errs = append(errs, addYamlSection(config, name, node)...)
+		case yamlFlowsKey:
+			if node.kind != yamlMapping {
+				errs.add(name, errMappingExpected)
+				continue
+			}
+			for _, flow := range node.keys {
+				errs = append(errs, addYamlFlow(config, flow, node.mapping[flow])...)
+			}
+		default:
+			errs.add(name, errUnknownSection)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return config, nil
+}
+
+func addYamlFlow(config *ini.File, name string, node yamlNode) (errs configErrors) {
+	routes, ok := node.mapping[yamlRoutesKey]
+	if !ok {
+		return addYamlSection(config, name, node)
+	}
+	delete(node.mapping, yamlRoutesKey)
+	errs = addYamlSection(config, name, node)
+	if routes.kind != yamlMapping {
+		errs.add(name, keyError(yamlRoutesKey, errMappingExpected))
+		return
+	}
+	for _, route := range routes.keys {
+		errs = append(errs, addYamlSection(config, routeSection(name, route), routes.mapping[route])...)
+	}
+	return
+}
+
+func addYamlSection(config *ini.File, name string, node yamlNode) (errs configErrors) {
+	if node.kind != yamlMapping && !node.empty() {
+		errs.add(name, errMappingExpected)
+		return
+	}
+	if _, err := config.GetSection(name); err == nil {
+		errs.add(name, errDuplicateSection)
+		return
+	}
+	section, err := config.NewSection(name)
+	if err != nil {
+		errs.add(name, err)
+		return
+	}
+	for _, key := range node.keys {
+		if value, ok := node.mapping[key]; ok {
+			errs.add(name, setYamlKey(section, key, value))
+		}
+	}
+	return
+}
+
+func setYamlKey(section *ini.Section, key string, node yamlNode) error {
+	switch node.kind {
+	case yamlMapping:
+		for _, nested := range node.keys {
+			if err := setYamlKey(section, key+"_"+nested, node.mapping[nested]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case yamlList:
+		items := make([]string, len(node.list))
+		for i, item := range node.list {
+			if item.kind != yamlScalar || strings.Contains(item.text, ",") {
+				return keyError(key, errInvalidValue)
+			}
+			items[i] = item.text
+		}
+		_, err := section.NewKey(key, strings.Join(items, ","))
+		return err
+	}
+	_, err := section.NewKey(key, node.text)
+	return err
+}
+
+/*
+Write INI config file as YAML. Values are copied as written, environment
+variables are not expanded and included files are not merged. Comments are
+not kept.
+*/
+func convertConfig(file string, out io.Writer) error {
+	config, err := ini.Load(file)
+	if err != nil {
+		return err
+	}
+	config.DeleteSection(ini.DEFAULT_SECTION)
+	var doc, flows yaml.MapSlice
+	routes := make(map[string]yaml.MapSlice)
+	for _, section := range config.Sections() {
+		name := section.Name()
+		if name == mainSectionName {
+			doc = append(doc, yaml.MapItem{Key: name, Value: yamlOptions(section)})
+			continue
+		}
+		if flow, route, ok := routeName(name); ok {
+			routes[flow] = append(routes[flow], yaml.MapItem{Key: route, Value: yamlOptions(section)})
+			continue
+		}
+		flows = append(flows, yaml.MapItem{Key: name, Value: yamlOptions(section)})
+	}
+	for i, flow := range flows {
+		if flowRoutes, ok := routes[flow.Key.(string)]; ok {
+			options := append(flow.Value.(yaml.MapSlice), yaml.MapItem{Key: yamlRoutesKey, Value: flowRoutes})
+			flows[i].Value = options
+		}
+	}
+	if len(flows) > 0 {
+		doc = append(doc, yaml.MapItem{Key: yamlFlowsKey, Value: flows})
+	}
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+func yamlOptions(section *ini.Section) (options yaml.MapSlice) {
+	for _, key := range section.Keys() {
+		var value interface{} = key.Value()
+		if listKeys[key.Name()] {
+			value = key.Strings(",")
+		}
+		options = append(options, yaml.MapItem{Key: key.Name(), Value: value})
+	}
+	return
+}
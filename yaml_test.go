@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const iniRoutesConfig = `[main]
+log_level = info
+[app]
+group = app
+stream = all
+source = unix:///tmp/app.sock
+socket_mode = 0660
+tls_cert_file = app.pem
+include_tags = app*,web
+queue_size = 100
+max_retry_age = 30m
+[route:app.errors]
+group = app
+stream = errors
+min_severity = err
+`
+
+const yamlRoutesConfig = `main:
+  log_level: info
+flows:
+  app:
+    group: app
+    stream: all
+    source: unix:///tmp/app.sock
+    socket_mode: 0660
+    tls:
+      cert_file: app.pem
+    include_tags: [app*, web]
+    queue_size: 100
+    max_retry_age: 30m
+    routes:
+      errors:
+        group: app
+        stream: errors
+        min_severity: err
+`
+
+// Assert that YAML config is mapped to the same flows as INI one.
+func Test_LoadConfig_yaml(t *testing.T) {
+	iniFile, remove := tempConfig(t, "config.ini", iniRoutesConfig, "config.yaml", yamlRoutesConfig)
+	defer remove()
+	iniCfg, err := LoadConfig(iniFile)
+	assert.Nil(t, err)
+	yamlCfg, err := LoadConfig(filepath.Join(filepath.Dir(iniFile), "config.yaml"))
+	assert.Nil(t, err)
+	assert.IsType(t, &YamlConfig{}, yamlCfg)
+	assert.Equal(t, iniCfg.GetMain(), yamlCfg.GetMain())
+	assert.Equal(t, iniCfg.GetFlows(), yamlCfg.GetFlows())
+	assert.Equal(t, "0660", yamlCfg.GetFlows()[0].SocketMode)
+	assert.Equal(t, iniCfg.Validate(), yamlCfg.Validate())
+}
+
+func Test_LoadConfig_yaml_errors(t *testing.T) {
+	for content, expected := range map[string]string{
+		"logs:\n  app: {}\n":                          "[logs] unknown section",
+		"flows: [app]\n":                              "[flows] mapping expected",
+		"flows:\n  app: logs\n":                       "[app] mapping expected",
+		"- app\n- web\n":                              "mapping expected",
+		"main: [info]\n":                              "[main] mapping expected",
+		"flows:\n  app: [group, stream]\n":            "[app] mapping expected",
+		"flows:\n  app:\n    include_tags: [[a]]\n":   "[app] include_tags invalid value",
+		"flows:\n  app:\n    include_tags: ['a,b']\n": "[app] include_tags invalid value",
+		"flows:\n  app:\n    routes: [errors]\n":      "[app] routes mapping expected",
+	} {
+		file, remove := tempConfig(t, "config.yml", content)
+		_, err := LoadConfig(file)
+		remove()
+		assert.EqualError(t, err, expected)
+	}
+}
+
+// Assert that empty document and sections without options are accepted.
+func Test_LoadConfig_yaml_empty(t *testing.T) {
+	for _, content := range []string{"", "main:\nflows:\n  app:\n"} {
+		file, remove := tempConfig(t, "config.yml", content)
+		_, err := LoadConfig(file)
+		remove()
+		assert.Nil(t, err, content)
+	}
+}
+
+func Test_convertConfig(t *testing.T) {
+	iniFile, remove := tempConfig(t, "config.ini", iniRoutesConfig)
+	defer remove()
+	out := bytes.NewBuffer([]byte{})
+	assert.Nil(t, convertConfig(iniFile, out))
+	yamlFile := filepath.Join(filepath.Dir(iniFile), "config.yaml")
+	assert.Nil(t, ioutil.WriteFile(yamlFile, out.Bytes(), 0600))
+
+	iniCfg, err := LoadConfig(iniFile)
+	assert.Nil(t, err)
+	yamlCfg, err := LoadConfig(yamlFile)
+	assert.Nil(t, err)
+	assert.Equal(t, iniCfg.GetMain(), yamlCfg.GetMain())
+	assert.Equal(t, iniCfg.GetFlows(), yamlCfg.GetFlows())
+}